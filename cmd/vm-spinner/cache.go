@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+func defaultCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "vm-spinner")
+	}
+	return filepath.Join(os.TempDir(), "vm-spinner-cache")
+}
+
+func snapshotDir(c *cli.Context) string {
+	return filepath.Join(c.GlobalString("cache-dir"), "snapshots")
+}
+
+func cacheCommand() cli.Command {
+	return cli.Command{
+		Name:  "cache",
+		Usage: "Manage the snapshots of provisioned VMs",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the snapshots of provisioned VMs",
+				Action: runCacheList,
+			},
+			{
+				Name:      "clear",
+				Usage:     "Delete the snapshots of provisioned VMs",
+				ArgsUsage: "[image...]",
+				Description: "Delete the snapshots of provisioned VMs, so that the following runs provision VMs from scratch. " +
+					"All of them are deleted, unless image names are passed as arguments.",
+				Action: runCacheClear,
+			},
+		},
+	}
+}
+
+func runCacheList(c *cli.Context) error {
+	snapshots, err := vmbackends.ListSnapshots(snapshotDir(c))
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		fmt.Printf("%s\t%s\t%s\t%s\tcreated %s ago\n", s.Name, s.BoxName, s.Backend, s.ProviderName, time.Since(s.Created).Round(time.Second))
+	}
+	return nil
+}
+
+func runCacheClear(c *cli.Context) error {
+	err := initLog(c)
+	if err != nil {
+		return err
+	}
+	snapshots, err := vmbackends.ListSnapshots(snapshotDir(c))
+	if err != nil {
+		return err
+	}
+
+	failed, deleted := 0, 0
+	for _, s := range snapshots {
+		if c.NArg() > 0 && !contains(c.Args(), s.BoxName) {
+			continue
+		}
+		logger := log.WithFields(log.Fields{"vm": s.BoxName, "snapshot": s.Name})
+		info := make(chan string)
+		done := make(chan struct{})
+		go func() {
+			for l := range info {
+				logger.Debug(l)
+			}
+			close(done)
+		}()
+		err := vmbackends.DeleteSnapshot(context.Background(), s, info)
+		close(info)
+		<-done
+		if err != nil {
+			logger.Error(err.Error())
+			failed++
+			continue
+		}
+		deleted++
+		logger.Info("snapshot deleted")
+	}
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d snapshots could not be deleted", failed, failed+deleted), exitCodeInfraFailure)
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, e := range values {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
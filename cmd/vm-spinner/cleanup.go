@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmstate"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/workdir"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+func cleanupCommand() cli.Command {
+	return cli.Command{
+		Name:      "cleanup",
+		Usage:     "Destroy the VMs kept alive by previous runs",
+		ArgsUsage: "[path...]",
+		Description: "Destroy the VMs kept alive by previous runs with --keep-on-failure or --keep-always. " +
+			"All of them are destroyed, unless their paths or image names are passed as arguments.",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "list,l",
+				Usage: "Only list the kept VMs, without destroying them.",
+			},
+		},
+		Action: runCleanup,
+	}
+}
+
+func runCleanup(c *cli.Context) error {
+	err := initLog(c)
+	if err != nil {
+		return err
+	}
+	store, err := vmstate.Open(c.GlobalString("state-dir"))
+	if err != nil {
+		return err
+	}
+	records, err := store.List()
+	if err != nil {
+		return err
+	}
+	records = filterRecords(records, c.Args())
+
+	if c.Bool("list") {
+		for _, r := range records {
+			fmt.Printf("%s\t%s\t%s\tkept %s ago\t%s\n", r.Path, r.BoxName, r.Backend, time.Since(r.KeptAt).Round(time.Second), r.ShellCmd)
+		}
+		return nil
+	}
+
+	failed := 0
+	for _, r := range records {
+		logger := log.WithFields(log.Fields{"vm": r.BoxName, "path": r.Path})
+		err := destroyRecord(c, r)
+		if err != nil {
+			logger.Error(err.Error())
+			failed++
+			continue
+		}
+		err = store.Remove(r)
+		if err != nil {
+			logger.Error(err.Error())
+			failed++
+			continue
+		}
+		logger.Info("VM destroyed")
+		// The folder of the run is left empty once its last kept VM is gone
+		err = workdir.RemoveIfDone(filepath.Dir(r.Path))
+		if err != nil {
+			logger.Warnf("can't remove the run folder: %s", err)
+		}
+	}
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d VMs could not be destroyed", failed, len(records)), exitCodeInfraFailure)
+	}
+	return nil
+}
+
+// filterRecords returns the records of kept VMs matching any of the given paths or image names, or all of them if none is given
+func filterRecords(records []*vmstate.Record, names []string) []*vmstate.Record {
+	var res []*vmstate.Record
+	for _, r := range records {
+		if !r.Kept() {
+			continue
+		}
+		if len(names) == 0 {
+			res = append(res, r)
+			continue
+		}
+		for _, n := range names {
+			if n == r.Path || n == r.BoxName {
+				res = append(res, r)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// destroyRecord reattaches to the VM of r and destroys it
+func destroyRecord(c *cli.Context, r *vmstate.Record) error {
+	// The VM is already gone if its path is, eg: it got destroyed by hand
+	if _, err := os.Stat(r.Path); os.IsNotExist(err) {
+		return nil
+	}
+
+	backend, err := vmbackends.GetBackend(r.Backend)
+	if err != nil {
+		return err
+	}
+	loader, ok := backend.(vmbackends.VMBackendLoader)
+	if !ok {
+		return fmt.Errorf("'%s' backend can't reattach to VMs, destroy the VM in '%s' by hand", backend, r.Path)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout := c.GlobalDuration("teardown-timeout"); timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	defer cancel()
+	conf := &vmbackends.VMConfig{
+		Path:         r.Path,
+		BoxName:      r.BoxName,
+		ProviderName: r.ProviderName,
+		CPUs:         r.CPUs,
+		Memory:       r.Memory,
+	}
+	vm, err := loader.Load(ctx, conf)
+	if errors.Is(err, fs.ErrNotExist) {
+		// The VM did not get far enough in its creation to have any state to reattach to
+		return os.RemoveAll(r.Path)
+	}
+	if err != nil {
+		return err
+	}
+
+	info := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		for l := range info {
+			log.WithFields(log.Fields{"vm": r.BoxName}).Debug(l)
+		}
+		close(done)
+	}()
+	err = vm.Destroy(ctx, info)
+	close(info)
+	<-done
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(r.Path)
+}
+
+// newRecord describes the VM created from conf by this process, to be stored in the state folder
+func newRecord(backend vmbackends.VMBackend, conf *vmbackends.VMConfig) *vmstate.Record {
+	// VMs of the daemon pool run no job of their own
+	job := ""
+	if conf.Job != nil {
+		job = conf.Job.String()
+	}
+	return &vmstate.Record{
+		Backend:      backend.String(),
+		Path:         conf.Path,
+		BoxName:      conf.BoxName,
+		ProviderName: conf.ProviderName,
+		CPUs:         conf.CPUs,
+		Memory:       conf.Memory,
+		Job:          job,
+		Pid:          os.Getpid(),
+		Start:        time.Now(),
+	}
+}
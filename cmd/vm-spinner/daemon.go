@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmpool"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmstate"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/workdir"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Name of the daemon socket, in the state folder
+const daemonSocketFile = "daemon.sock"
+
+func daemonCommand() cli.Command {
+	return cli.Command{
+		Name:  "daemon",
+		Usage: "Keep a pool of booted VMs, lent to the jobs run by other vm-spinner invocations",
+		Description: "Keep --pool-size booted VMs for each of the images, until interrupted. " +
+			"Invocations running jobs with the same backend borrow them in place of creating new VMs, as long as the daemon is running and has an idle VM " +
+			"with the same image, provider, cpus and memory. Once the job is done, VMs are reset to their state right after boot, " +
+			"or replaced by new ones if the backend can't reset them. " +
+			"Invocations using --snapshot, --keep-on-failure or --keep-always never borrow VMs.",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:     "image,i",
+				Usage:    "VM image to keep booted VMs of, with the same format of the jobs one. Specify it multiple times for multiple images.",
+				Required: true,
+			},
+			cli.IntFlag{
+				Name:  "pool-size",
+				Usage: "Number of booted VMs to keep for each image.",
+				Value: 1,
+			},
+		},
+		Action: runDaemon,
+	}
+}
+
+// daemonSocket returns the socket of the daemon, as set by the global flags
+func daemonSocket(c *cli.Context) string {
+	if socket := c.GlobalString("daemon-socket"); len(socket) > 0 {
+		return socket
+	}
+	return filepath.Join(c.GlobalString("state-dir"), daemonSocketFile)
+}
+
+func runDaemon(c *cli.Context) error {
+	err := validateParameters(c)
+	if err != nil {
+		return err
+	}
+	err = initLog(c)
+	if err != nil {
+		return err
+	}
+	if c.Int("pool-size") < 1 {
+		return fmt.Errorf("wrong pool-size value %d, at least 1 VM per image is needed", c.Int("pool-size"))
+	}
+
+	backend, err := vmbackends.GetBackend(c.GlobalString("backend"))
+	if err != nil {
+		return err
+	}
+	if _, ok := backend.(vmbackends.VMBackendLoader); !ok {
+		return fmt.Errorf("'%v' backend can't reattach to VMs, thus it can't lend them to other processes", backend)
+	}
+	if b, ok := backend.(vmbackends.VMBackendConfigurator); ok {
+		err = b.ParseCfg(c)
+		if err != nil {
+			return err
+		}
+	}
+	images, err := parseImages(c)
+	if err != nil {
+		return err
+	}
+	bootRetry, err := parseBootRetry(c)
+	if err != nil {
+		return err
+	}
+	store, err := vmstate.Open(c.GlobalString("state-dir"))
+	if err != nil {
+		return err
+	}
+
+	socket := daemonSocket(c)
+	if vmpool.Running(socket) {
+		return fmt.Errorf("a daemon is already listening on '%s'", socket)
+	}
+	// Left behind by a daemon that did not exit cleanly
+	_ = os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	run, err := workdir.NewRun(c.GlobalString("workdir"))
+	if err != nil {
+		return err
+	}
+	defer run.Close()
+
+	pool := vmpool.New(backend, run, c.GlobalInt("parallelism"))
+	var recordsMu sync.Mutex
+	records := make(map[*vmbackends.VMConfig]*vmstate.Record)
+	pool.Hooks = vmpool.Hooks{
+		Created: func(conf *vmbackends.VMConfig) {
+			// record the VM before creating it, so that it can be garbage collected
+			// if the daemon dies without destroying it
+			r := newRecord(backend, conf)
+			if err := store.Save(r); err != nil {
+				log.WithFields(log.Fields{"vm": conf.BoxName}).Errorf("can't record VM: %s", err)
+			}
+			recordsMu.Lock()
+			records[conf] = r
+			recordsMu.Unlock()
+		},
+		Ready: func(conf *vmbackends.VMConfig) {
+			log.WithFields(log.Fields{"vm": conf.BoxName, "path": conf.Path}).Info("VM ready")
+		},
+		Lent: func(conf *vmbackends.VMConfig) {
+			log.WithFields(log.Fields{"vm": conf.BoxName, "path": conf.Path}).Info("VM lent")
+		},
+		Destroyed: func(conf *vmbackends.VMConfig, err error) {
+			logger := log.WithFields(log.Fields{"vm": conf.BoxName, "path": conf.Path})
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			recordsMu.Lock()
+			r := records[conf]
+			delete(records, conf)
+			recordsMu.Unlock()
+			if r == nil {
+				return
+			}
+			if rmErr := store.Remove(r); rmErr != nil {
+				logger.Errorf("can't record VM: %s", rmErr)
+			}
+			logger.Info("VM destroyed")
+		},
+		Info: func(conf *vmbackends.VMConfig, line string) {
+			log.WithFields(log.Fields{"vm": conf.BoxName}).Debug(line)
+		},
+	}
+
+	sigCtx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(sigCtx)
+	defer cancel()
+	for _, image := range images {
+		pool.Start(ctx, &vmbackends.VMConfig{
+			BoxName:      image.Name,
+			ProviderName: c.GlobalString("provider"),
+			CPUs:         image.CPUs,
+			Memory:       image.Memory,
+
+			BootTimeout:     c.GlobalDuration("boot-timeout"),
+			TeardownTimeout: c.GlobalDuration("teardown-timeout"),
+			BootRetry:       bootRetry,
+		}, c.Int("pool-size"))
+	}
+	log.Infof("Keeping %d VMs of each of %v images with %v backend, listening on '%s'", c.Int("pool-size"), vmjobs.ImageNames(c.StringSlice("image")), backend, socket)
+
+	go func() {
+		<-ctx.Done()
+		log.Info("Stopping, lent VMs are destroyed once their job is done")
+		l.Close()
+	}()
+	err = pool.Serve(l)
+	cancel()
+	pool.Wait()
+	return err
+}
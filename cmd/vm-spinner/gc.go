@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmstate"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/workdir"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+func gcCommand() cli.Command {
+	return cli.Command{
+		Name:  "gc",
+		Usage: "Destroy the VMs left behind by vm-spinner processes that did not exit cleanly",
+		Description: "Destroy the VMs whose owner process is gone, eg: because it got killed, and the ones older than --ttl. " +
+			"VMs kept alive with --keep-on-failure or --keep-always are skipped, unless --kept is set. " +
+			"Run folders left empty in --workdir are deleted as well.",
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name:  "ttl",
+				Usage: "Destroy VMs older than this, even if their owner process is still running. 0 to only destroy orphaned VMs.",
+			},
+			cli.BoolFlag{
+				Name:  "kept",
+				Usage: "Whether to destroy VMs kept alive as well, if older than --ttl or if --ttl is 0.",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Only list the VMs to be destroyed, without destroying them.",
+			},
+		},
+		Action: runGC,
+	}
+}
+
+// gcReason returns why the VM of r must be garbage collected, or an empty string if it must not
+func gcReason(r *vmstate.Record, ttl time.Duration, kept bool) string {
+	expired := ttl > 0 && time.Since(r.Start) > ttl
+	switch {
+	case r.Kept():
+		if kept && (ttl == 0 || expired) {
+			return "kept"
+		}
+	case expired:
+		return "expired"
+	case !r.OwnerAlive():
+		return "orphaned"
+	}
+	return ""
+}
+
+func runGC(c *cli.Context) error {
+	err := initLog(c)
+	if err != nil {
+		return err
+	}
+	store, err := vmstate.Open(c.GlobalString("state-dir"))
+	if err != nil {
+		return err
+	}
+	records, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	collected, failed := 0, 0
+	for _, r := range records {
+		reason := gcReason(r, c.Duration("ttl"), c.Bool("kept"))
+		if len(reason) == 0 {
+			continue
+		}
+		collected++
+		logger := log.WithFields(log.Fields{"vm": r.BoxName, "path": r.Path, "pid": r.Pid, "age": time.Since(r.Start).Round(time.Second), "reason": reason})
+		if c.Bool("dry-run") {
+			logger.Info("VM to be destroyed")
+			continue
+		}
+		err := destroyRecord(c, r)
+		if err == nil {
+			err = store.Remove(r)
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			failed++
+			continue
+		}
+		logger.Info("VM destroyed")
+	}
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d of %d VMs could not be destroyed", failed, collected), exitCodeInfraFailure)
+	}
+	if c.Bool("dry-run") {
+		return nil
+	}
+	// Runs might have been killed before having any VM, or after all of them got destroyed
+	return workdir.Prune(c.GlobalString("workdir"))
+}
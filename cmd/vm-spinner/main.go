@@ -3,17 +3,31 @@ package main
 import (
 	"context"
 	"fmt"
-	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vagrant"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/scheduler"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
 	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmpool"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmstate"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/workdir"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
-	"golang.org/x/sync/semaphore"
+
+	// Trigger init() on default (internal) VM backends
+	_ "github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends/container"
+	_ "github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends/fake"
+	_ "github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends/firecracker"
+	_ "github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends/qemu"
+	_ "github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends/vagrant"
 
 	// Trigger init() on default (internal) job plugins
 	_ "github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs/bpf"
@@ -22,16 +36,64 @@ import (
 	_ "github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs/ssh"
 )
 
+// vmOutput is either an output line or the final result of a VM
 type vmOutput struct {
-	VM   string
-	Line string
+	VM     string
+	Line   vmjobs.OutputLine
+	Result *vmjobs.VMResult
+}
+
+// createdVMs -> memory taken by the VMs created by this process, in place of being borrowed from the daemon
+type createdVMs struct {
+	sched *scheduler.Scheduler
+
+	mu sync.Mutex
+	// memory -> memory taken by each VM, by its path
+	memory map[string]int
+}
+
+// acquire waits for the memory of the VM of conf, once per VM as its creation might be retried
+func (v *createdVMs) acquire(ctx context.Context, conf *vmbackends.VMConfig) error {
+	v.mu.Lock()
+	_, ok := v.memory[conf.Path]
+	v.mu.Unlock()
+	if ok {
+		return nil
+	}
+	err := v.sched.AcquireMemory(ctx, conf.Memory)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.memory[conf.Path] = conf.Memory
+	v.mu.Unlock()
+	return nil
+}
+
+// release gives back the memory of the VM in path, if it was created
+func (v *createdVMs) release(path string) {
+	v.mu.Lock()
+	memory, ok := v.memory[path]
+	delete(v.memory, path)
+	v.mu.Unlock()
+	if ok {
+		v.sched.ReleaseMemory(memory)
+	}
 }
 
 func defaultMemory() int {
 	return 1024
 }
 
+func defaultMemoryReserve() int {
+	return 1024
+}
+
 func defaultParallelism() int {
+	// Always allow at least one VM, even on single CPU hosts
+	if runtime.NumCPU() < 2 {
+		return 1
+	}
 	return runtime.NumCPU() / 2
 }
 
@@ -40,10 +102,6 @@ func defaultNumCPUs() int {
 }
 
 func main() {
-	app := cli.NewApp()
-	app.Name = "vm-spinner"
-	app.Usage = "Run your workloads on ephemeral Virtual Machines"
-
 	for i, arg := range os.Args {
 		if arg == "--plugin-dir" && len(os.Args) > i+1 {
 			err := vmjobs.LoadPlugins(os.Args[i+1])
@@ -54,6 +112,18 @@ func main() {
 		}
 	}
 
+	err := newApp().Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newApp builds the cli app, with a command for each of the jobs registered so far
+func newApp() *cli.App {
+	app := cli.NewApp()
+	app.Name = "vm-spinner"
+	app.Usage = "Run your workloads on ephemeral Virtual Machines"
+
 	for _, j := range vmjobs.ListJobs() {
 		job := j
 
@@ -93,12 +163,22 @@ func main() {
 		}
 		app.Commands = append(app.Commands, cmd)
 	}
+	app.Commands = append(app.Commands, manifestCommand(), cleanupCommand(), gcCommand(), cacheCommand(), daemonCommand())
 
 	// Global flags
+	var backendNames []string
+	for _, b := range vmbackends.ListBackends() {
+		backendNames = append(backendNames, b.String())
+	}
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "backend,b",
+			Usage: "VM backend name, between { " + strings.Join(backendNames, ", ") + " }.",
+			Value: vmbackends.DefaultBackend,
+		},
 		cli.StringFlag{
 			Name:  "provider,p",
-			Usage: "Vagrant provider name.",
+			Usage: "Vagrant provider name, between { virtualbox, libvirt, vmware_desktop, hyperv, parallels }.",
 			Value: "virtualbox",
 		},
 		// This is fake, ie: we will parse it instead of let it be parsed by the library,
@@ -109,9 +189,15 @@ func main() {
 		},
 		cli.IntFlag{
 			Name:  "memory",
-			Usage: "The amount of memory (in bytes) allocated for each VM.",
+			Usage: "The amount of memory (in MB) allocated for each VM.",
 			Value: defaultMemory(),
 		},
+		cli.IntFlag{
+			Name: "memory-reserve",
+			Usage: "The amount of host memory (in MB) left to anything but VMs. VMs only start as long as their memory fits in the memory " +
+				"available on the host when the run starts, minus this reserve, and so do their CPUs in the host ones. VMs needing more memory than that run alone.",
+			Value: defaultMemoryReserve(),
+		},
 		cli.IntFlag{
 			Name:  "cpus",
 			Usage: "The number of cpus allocated for each VM.",
@@ -122,6 +208,92 @@ func main() {
 			Usage: "The number of VM to spawn in parallel.",
 			Value: defaultParallelism(),
 		},
+		cli.StringFlag{
+			Name: "fail-on",
+			Usage: fmt.Sprintf("When to exit with a failure status, between { any, all, none } of the VMs failing. "+
+				"Exit code is %d if any VM failed for infrastructure reasons (eg: it did not boot), %d if only jobs failed. "+
+				"Cancelled runs (eg: by a signal) exit with %d whatever the policy, unless they failed according to it.",
+				exitCodeInfraFailure, exitCodeJobFailure, exitCodeCancelled),
+			Value: failOnAny,
+		},
+		cli.BoolFlag{
+			Name:  "fail-fast",
+			Usage: "Whether to cancel the remaining VMs as soon as one of them fails. Running VMs are torn down before exiting.",
+		},
+		cli.DurationFlag{
+			Name:  "boot-timeout",
+			Usage: "Maximum time for each VM to boot, 0 for no limit.",
+			Value: 15 * time.Minute,
+		},
+		cli.IntFlag{
+			Name:  "boot-attempts",
+			Usage: "Maximum number of times each VM is created and booted, when failing for transient reasons. Failed VMs are destroyed before retrying.",
+			Value: 3,
+		},
+		cli.DurationFlag{
+			Name:  "boot-retry-backoff",
+			Usage: "Wait before retrying to boot a VM, doubled at each following retry.",
+			Value: 30 * time.Second,
+		},
+		cli.StringSliceFlag{
+			Name: "boot-retry-on",
+			Usage: "Regular expression matching the errors, or the boot output, of the boot failures to be retried. Specify it multiple times for multiple expressions. " +
+				"Defaults to well known transient failures, such as network errors and VirtualBox lock errors. Use '.' to retry on any failure.",
+		},
+		cli.BoolFlag{
+			Name:  "boot-retry-timeouts",
+			Usage: "Whether to retry the boots exceeding --boot-timeout as well, as long as they match --boot-retry-on. They are not retried by default, as each attempt takes the whole timeout.",
+		},
+		cli.DurationFlag{
+			Name:  "job-timeout",
+			Usage: "Maximum time for the job to run on each VM, 0 for no limit.",
+		},
+		cli.DurationFlag{
+			Name:  "teardown-timeout",
+			Usage: "Maximum time for each VM to be halted, and then to be destroyed. VMs are torn down even if the run is cancelled.",
+			Value: 5 * time.Minute,
+		},
+		cli.BoolFlag{
+			Name:  "keep-on-failure",
+			Usage: "Whether to keep failed VMs alive, in place of tearing them down, to debug them. Destroy them later with the 'cleanup' command.",
+		},
+		cli.BoolFlag{
+			Name:  "keep-always",
+			Usage: "Whether to keep all VMs alive after their job, in place of tearing them down. Destroy them later with the 'cleanup' command.",
+		},
+		cli.BoolFlag{
+			Name: "snapshot",
+			Usage: "Whether to create VMs from snapshots of provisioned VMs, for jobs having a provisioning step. " +
+				"Snapshots are taken the first time they are needed, and reused by following runs until cleared with the 'cache clear' command.",
+		},
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Usage: "Folder where the snapshots are stored.",
+			Value: defaultCacheDir(),
+		},
+		cli.StringFlag{
+			Name:  "workdir",
+			Usage: "Folder containing the folders of the VMs. Each run gets its own folder in it, named after a unique run ID.",
+			Value: workdir.DefaultRoot(),
+		},
+		cli.StringFlag{
+			Name: "artifacts-dir",
+			Usage: "Folder where the artifacts of the jobs (eg: build products) are downloaded to. " +
+				"Each run gets its own folder in it, named after its run ID, with a folder for each VM. No artifact is downloaded if empty.",
+		},
+		cli.StringFlag{
+			Name:  "state-dir",
+			Usage: "Folder where the VMs are recorded while they exist, to destroy the ones left behind with the 'cleanup' and 'gc' commands.",
+			Value: vmstate.DefaultDir(),
+		},
+		cli.StringFlag{
+			Name:  "daemon-socket",
+			Usage: "Socket of the 'daemon' command, which jobs borrow booted VMs from when it is running. Defaults to a socket in --state-dir.",
+		},
+		cli.BoolFlag{
+			Name:  "no-daemon",
+			Usage: "Whether to always create new VMs, even if the daemon is running.",
+		},
 		cli.BoolFlag{
 			Name:  "log.json",
 			Usage: "Whether to log output in json format.",
@@ -137,10 +309,14 @@ func main() {
 		},
 	}
 
-	err := app.Run(os.Args)
-	if err != nil {
-		log.Fatal(err)
+	// Backend specific global flags
+	for _, b := range vmbackends.ListBackends() {
+		if configBackend, ok := b.(vmbackends.VMBackendConfigurator); ok {
+			app.Flags = append(app.Flags, configBackend.Flags()...)
+		}
 	}
+
+	return app
 }
 
 func validateParameters(c *cli.Context) error {
@@ -152,13 +328,60 @@ func validateParameters(c *cli.Context) error {
 		return fmt.Errorf("number of parallel VMs (%d) exceeds the number of CPUs available (%d)", c.Int("parallelism"), runtime.NumCPU())
 	}
 
-	if c.GlobalInt("parallelism")*c.GlobalInt("cpus") > runtime.NumCPU() {
-		fmt.Printf("warning: number of parallel cpus (cpus * parallelism %d) exceeds the number of CPUs available (%d)\n", c.Int("parallelism")*c.Int("cpus"), runtime.NumCPU())
+	if err := validateFailOn(c.GlobalString("fail-on")); err != nil {
+		return err
 	}
 
 	return nil
 }
 
+// parseImages parses the "image" flag values, applying the global resources
+// to the images that do not override them
+func parseImages(c *cli.Context) ([]vmjobs.Image, error) {
+	var images []vmjobs.Image
+	for _, spec := range c.StringSlice("image") {
+		image, err := vmjobs.ParseImage(spec)
+		if err != nil {
+			return nil, err
+		}
+		if image.CPUs == 0 {
+			image.CPUs = c.GlobalInt("cpus")
+		}
+		if image.Memory == 0 {
+			image.Memory = c.GlobalInt("memory")
+		}
+		if image.CPUs > runtime.NumCPU() {
+			return nil, fmt.Errorf("number of CPUs for '%s' VM (%d) exceeds the number of CPUs available (%d)", image.Name, image.CPUs, runtime.NumCPU())
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// parseBootRetry parses the retry policy of VM boots from the "boot-*" flags
+func parseBootRetry(c *cli.Context) (vmbackends.RetryPolicy, error) {
+	policy := vmbackends.RetryPolicy{
+		MaxAttempts:   c.GlobalInt("boot-attempts"),
+		Backoff:       c.GlobalDuration("boot-retry-backoff"),
+		RetryTimeouts: c.GlobalBool("boot-retry-timeouts"),
+	}
+	if policy.MaxAttempts < 1 {
+		return policy, fmt.Errorf("wrong boot-attempts value %d, at least 1 attempt is needed", policy.MaxAttempts)
+	}
+	patterns := c.GlobalStringSlice("boot-retry-on")
+	if len(patterns) == 0 {
+		patterns = vmbackends.DefaultRetryable
+	}
+	for _, p := range patterns {
+		r, err := regexp.Compile(p)
+		if err != nil {
+			return policy, fmt.Errorf("wrong boot-retry-on expression '%s': %s", p, err)
+		}
+		policy.Retryable = append(policy.Retryable, r)
+	}
+	return policy, nil
+}
+
 func initLog(c *cli.Context) error {
 	// Log as JSON instead of the default ASCII formatter.
 	if c.GlobalBool("log.json") {
@@ -201,6 +424,24 @@ func runApp(c *cli.Context, job vmjobs.VMJob) error {
 		return err
 	}
 
+	backend, err := vmbackends.GetBackend(c.GlobalString("backend"))
+	if err != nil {
+		return err
+	}
+	if b, ok := backend.(vmbackends.VMBackendKernelSharer); ok && b.SharesHostKernel() {
+		if j, ok := job.(vmjobs.VMJobKernelDependent); ok && j.NeedsKernel() {
+			return fmt.Errorf("'%v' job depends on the VM kernel, and can't run on '%v' backend as it shares the host kernel", job, backend)
+		}
+		log.Warnf("'%v' backend shares the host kernel, jobs won't run on the kernel of the requested images", backend)
+	}
+
+	if b, ok := backend.(vmbackends.VMBackendConfigurator); ok {
+		err = b.ParseCfg(c)
+		if err != nil {
+			return err
+		}
+	}
+
 	if j, ok := job.(vmjobs.VMJobConfigurator); ok {
 		err = j.ParseCfg(c)
 		if err != nil {
@@ -213,35 +454,112 @@ func runApp(c *cli.Context, job vmjobs.VMJob) error {
 		resWg sync.WaitGroup
 		resCh chan vmOutput
 	)
-	if j, ok := job.(vmjobs.VMJobProcessor); ok {
+	lineProcessor, isLineProcessor := vmjobs.LineProcessor(job)
+	resultProcessor, isResultProcessor := job.(vmjobs.VMJobResultProcessor)
+	if isLineProcessor || isResultProcessor {
 		resCh = make(chan vmOutput)
 		resWg.Add(1)
 		go func() {
 			for res := range resCh {
-				j.Process(res.VM, res.Line)
+				switch {
+				case res.Result != nil && isResultProcessor:
+					resultProcessor.ProcessResult(res.Result)
+				case res.Result == nil && isLineProcessor:
+					lineProcessor.ProcessLine(res.VM, res.Line)
+				}
 			}
 			resWg.Done()
 		}()
 	}
 
-	// Unlock sm.Acquire() call killing its context on external signals, allowing us
-	// to avoid situations when some images are waiting on sm.Acquire() call,
+	// Unlock sched.Acquire() call killing its context on external signals, allowing us
+	// to avoid situations when some images are waiting on sched.Acquire() call,
 	// and current images gets killed by an external signal (managed in vagrant.go),
 	// we proceed to process subsequent images because main thread did not notice anything.
-	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	// The same context is cancelled on the first failure in fail-fast mode, so that
+	// no more VMs are started and the running ones are torn down as soon as possible.
+	sigCtx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(sigCtx)
+	defer cancel()
 
 	// prepare sync primitives.
 	// the waitgrup is used to run all the VM in parallel, and to
 	// join with each worker goroutine once their job is finished.
-	// the semapthore is used to ensure that the parallelism upper
-	// limit gets respected.
-	var wg sync.WaitGroup
-	sm := semaphore.NewWeighted(int64(c.GlobalInt("parallelism")))
+	// the scheduler is used to ensure that the parallelism upper
+	// limit gets respected, and that VMs do not overcommit the host.
+	var (
+		wg      sync.WaitGroup
+		summary runSummary
+	)
+	capacity, err := scheduler.HostCapacity(c.GlobalInt("memory-reserve"))
+	if err != nil {
+		return err
+	}
+	sharer, sharesMemory := backend.(vmbackends.VMBackendMemorySharer)
+	sharesMemory = sharesMemory && sharer.SharesHostMemory()
+	if sharesMemory {
+		capacity.Memory = 0
+	}
+	sched := scheduler.New(capacity, c.GlobalInt("parallelism"))
+	switch {
+	case sharesMemory:
+		log.Debugf("'%v' backend shares the host memory, scheduling VMs within %d CPUs only", backend, capacity.CPUs)
+	case capacity.Memory > 0:
+		log.Debugf("Scheduling VMs within %d CPUs and %d MB of memory", capacity.CPUs, capacity.Memory)
+	default:
+		log.Warnf("Host memory is unknown, scheduling VMs within %d CPUs only", capacity.CPUs)
+	}
 
-	images := c.StringSlice("image")
-	log.Infof("Running '%v' job on %v images", job, images)
+	images, err := parseImages(c)
+	if err != nil {
+		return err
+	}
+	summary.total = len(images)
+	for _, image := range images {
+		resources := scheduler.Resources{CPUs: image.CPUs, Memory: image.Memory}
+		if err := sched.Fits(resources); err != nil {
+			return fmt.Errorf("'%s' VM can't run on this host: %s", image.Name, err)
+		}
+		if sched.Alone(resources) {
+			log.Warnf("'%s' VM needs %d MB of memory, more than the %d MB available: it runs alone", image.Name, image.Memory, capacity.Memory)
+		}
+	}
+	bootRetry, err := parseBootRetry(c)
+	if err != nil {
+		return err
+	}
+	keep := vmbackends.KeepNever
+	switch {
+	case c.GlobalBool("keep-always"):
+		keep = vmbackends.KeepAlways
+	case c.GlobalBool("keep-on-failure"):
+		keep = vmbackends.KeepOnFailure
+	}
+	store, err := vmstate.Open(c.GlobalString("state-dir"))
+	if err != nil {
+		return err
+	}
+	// VMs lent by the daemon are neither provisioned from snapshots nor kept alive.
+	// They take no memory of their own, as the daemon booted them already, thus
+	// VMs only wait for their memory once they are created by this process.
+	var created *createdVMs
+	if socket := daemonSocket(c); !c.GlobalBool("no-daemon") && !c.GlobalBool("snapshot") && keep == vmbackends.KeepNever && vmpool.Running(socket) {
+		log.Infof("Borrowing VMs from the daemon listening on '%s', when it has idle ones", socket)
+		created = &createdVMs{sched: sched, memory: make(map[string]int)}
+		backend = vmpool.NewBackend(backend, socket, created.acquire)
+	}
+	run, err := workdir.NewRun(c.GlobalString("workdir"))
+	if err != nil {
+		return err
+	}
+	defer run.Close()
+	log.Infof("Running '%v' job on %v images with %v backend, in '%s'", job, vmjobs.ImageNames(c.StringSlice("image")), backend, run.Dir)
 	for i, image := range images {
-		smErr := sm.Acquire(ctx, 1)
+		resources := scheduler.Resources{CPUs: image.CPUs, Memory: image.Memory}
+		if created != nil {
+			resources.Memory = 0
+		}
+		smErr := sched.Acquire(ctx, resources)
 		// Acquire may return non-nil err even if ctx.Done() is triggered
 		if smErr != nil || ctx.Err() != nil {
 			break
@@ -250,59 +568,134 @@ func runApp(c *cli.Context, job vmjobs.VMJob) error {
 		wg.Add(1)
 
 		// launch the VM for this image
-		name := fmt.Sprintf("/tmp/%s-%d", image, i)
-		conf := &vagrant.VMConfig{
-			Path:         name,
-			BoxName:      image,
+		conf := &vmbackends.VMConfig{
+			Path:         run.VMPath(i, image.Name),
+			BoxName:      image.Name,
 			ProviderName: c.GlobalString("provider"),
-			CPUs:         c.GlobalInt("cpus"),
-			Memory:       c.GlobalInt("memory"),
+			CPUs:         image.CPUs,
+			Memory:       image.Memory,
 			Job:          job,
+
+			BootTimeout:     c.GlobalDuration("boot-timeout"),
+			JobTimeout:      c.GlobalDuration("job-timeout"),
+			TeardownTimeout: c.GlobalDuration("teardown-timeout"),
+			BootRetry:       bootRetry,
+			Keep:            keep,
+		}
+		if c.GlobalBool("snapshot") {
+			conf.SnapshotDir = snapshotDir(c)
+		}
+		// artifacts are kept in a folder named as the VM one, as the latter is deleted with the VM
+		if artifactsDir := c.GlobalString("artifacts-dir"); len(artifactsDir) > 0 {
+			conf.ArtifactsDir = filepath.Join(artifactsDir, run.ID, filepath.Base(conf.Path))
 		}
 
 		// worker goroutine
 		go func() {
 			defer func() {
-				sm.Release(1)
+				if created != nil {
+					created.release(conf.Path)
+				}
+				sched.Release(resources)
 				wg.Done()
 			}()
 
-			// select the VM outputs
-			channels := vagrant.RunVirtualMachine(conf)
+			// record the VM before creating it, so that it can be garbage collected
+			// if this process dies without destroying it
 			logger := log.WithFields(log.Fields{"vm": conf.BoxName, "job": job.String()})
+			record := newRecord(backend, conf)
+			if err := store.Save(record); err != nil {
+				logger.Errorf("can't record VM: %s", err)
+			}
+
+			// select the VM outputs
+			channels := vmbackends.RunVirtualMachine(ctx, backend, conf)
 			logger.Info("job starting")
-			for {
+			output, debug, info, errs := channels.CmdOutput, channels.Debug, channels.Info, channels.Error
+			for output != nil || debug != nil || info != nil || errs != nil {
 				select {
-				case <-channels.Done:
-					logger.Info("job finished")
-					return
-				case l := <-channels.CmdOutput:
-					logger.Info(l)
+				case l, ok := <-output:
+					if !ok {
+						output = nil
+						continue
+					}
+					if l.Stream == vmjobs.StreamStderr {
+						logger.WithFields(log.Fields{"stream": l.Stream}).Info(l.Text)
+					} else {
+						logger.Info(l.Text)
+					}
 					if resCh != nil {
 						resCh <- vmOutput{VM: conf.BoxName, Line: l}
 					}
-				case l := <-channels.Debug:
+				case l, ok := <-debug:
+					if !ok {
+						debug = nil
+						continue
+					}
 					logger.Trace(l)
-				case l := <-channels.Info:
+				case l, ok := <-info:
+					if !ok {
+						info = nil
+						continue
+					}
 					logger.Debug(l)
-				case err := <-channels.Error:
+				case err, ok := <-errs:
+					if !ok {
+						errs = nil
+						continue
+					}
 					logger.Error(err.Error())
 				}
 			}
+
+			// all the lines have been received, the result comes last
+			res := <-channels.Done
+			summary.add(res)
+			var err error
+			if len(res.KeptPath) > 0 {
+				record.KeptAt = res.End
+				record.ShellCmd = res.ShellCmd
+				err = store.Save(record)
+			} else {
+				err = store.Remove(record)
+			}
+			if err != nil {
+				logger.Errorf("can't record VM: %s", err)
+			}
+			if c.GlobalBool("fail-fast") && res.Status == vmjobs.VMStatusFailed {
+				logger.Warn("fail-fast: cancelling remaining VMs")
+				cancel()
+			}
+			fields := log.Fields{"status": res.Summary(), "duration": res.End.Sub(res.Start).Round(time.Second)}
+			if res.Err != nil {
+				fields["error"] = res.Err.Error()
+			}
+			if len(res.ArtifactsDir) > 0 {
+				fields["artifacts"] = res.ArtifactsDir
+			}
+			if res.DroppedDebugLines > 0 {
+				fields["droppedDebugLines"] = res.DroppedDebugLines
+			}
+			logger.WithFields(fields).Info("job finished")
+			if resCh != nil {
+				resCh <- vmOutput{VM: conf.BoxName, Result: res}
+			}
 		}()
 	}
 
 	// wait for all workers
 	wg.Wait()
 
-	if j, ok := job.(vmjobs.VMJobProcessor); ok {
+	if resCh != nil {
 		// Close summary matrix channel and wait
 		// for it to eventually print the summary
 		close(resCh)
 		resWg.Wait()
-
+	}
+	if isLineProcessor {
 		// Notify job that we're done
-		j.Done()
+		lineProcessor.Done()
 	}
-	return nil
+	summary.printKept()
+	return summary.exitErr(c.GlobalString("fail-on"))
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// manifest is a declarative description of a run. It gets translated into
+// the equivalent command line, so that it goes through the very same
+// parsing and validation of the flags.
+type manifest struct {
+	Backend     string `yaml:"backend"`
+	Provider    string `yaml:"provider"`
+	CPUs        int    `yaml:"cpus"`
+	Memory      int    `yaml:"memory"`
+	Parallelism int    `yaml:"parallelism"`
+	PluginDir   string `yaml:"plugin-dir"`
+	// Flags -> any other global flag (eg: backend specific ones)
+	Flags map[string]interface{} `yaml:"flags"`
+	Job   struct {
+		Name  string                 `yaml:"name"`
+		Flags map[string]interface{} `yaml:"flags"`
+	} `yaml:"job"`
+	Images []manifestImage `yaml:"images"`
+}
+
+// manifestImage is either a plain "image" flag value, or its expanded form
+type manifestImage struct {
+	Name   string `yaml:"name"`
+	CPUs   int    `yaml:"cpus"`
+	Memory int    `yaml:"memory"`
+}
+
+func (i *manifestImage) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var spec string
+	if err := unmarshal(&spec); err == nil {
+		img, err := vmjobs.ParseImage(spec)
+		if err != nil {
+			return err
+		}
+		*i = manifestImage{Name: img.Name, CPUs: img.CPUs, Memory: img.Memory}
+		return nil
+	}
+	type plain manifestImage
+	return unmarshal((*plain)(i))
+}
+
+func (i *manifestImage) spec() string {
+	var overrides []string
+	if i.CPUs > 0 {
+		overrides = append(overrides, "cpus="+strconv.Itoa(i.CPUs))
+	}
+	if i.Memory > 0 {
+		overrides = append(overrides, "mem="+strconv.Itoa(i.Memory))
+	}
+	if len(overrides) == 0 {
+		return i.Name
+	}
+	return i.Name + ":" + strings.Join(overrides, ",")
+}
+
+func manifestCommand() cli.Command {
+	return cli.Command{
+		Name:        "run",
+		Usage:       "Run a job as described by a YAML manifest",
+		Description: "Run a job as described by a YAML manifest. Global flags set on the command line take precedence over the manifest ones.",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:     "file,f",
+				Usage:    "YAML manifest describing the run.",
+				Required: true,
+			},
+		},
+		Action: runManifest,
+	}
+}
+
+func loadManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	err = yaml.UnmarshalStrict(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(m.Job.Name) == 0 {
+		return nil, fmt.Errorf("%s: missing job name", path)
+	}
+	return m, nil
+}
+
+// flagArgs translates flags into command line arguments, sorted by name so that they are reproducible
+func flagArgs(flags map[string]interface{}) ([]string, error) {
+	names := make([]string, 0, len(flags))
+	for n := range flags {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, n := range names {
+		switch v := flags[n].(type) {
+		case nil:
+			return nil, errors.New("missing value for '" + n + "' flag")
+		case map[interface{}]interface{}:
+			return nil, errors.New("unsupported value for '" + n + "' flag")
+		case []interface{}:
+			for _, e := range v {
+				args = append(args, fmt.Sprintf("--%s=%v", n, e))
+			}
+		default:
+			args = append(args, fmt.Sprintf("--%s=%v", n, v))
+		}
+	}
+	return args, nil
+}
+
+// args translates the manifest into global flags and job command line arguments
+func (m *manifest) args() (globalArgs, jobArgs []string, err error) {
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{"backend", m.Backend},
+		{"provider", m.Provider},
+		{"plugin-dir", m.PluginDir},
+	} {
+		if len(f.value) > 0 {
+			globalArgs = append(globalArgs, "--"+f.name+"="+f.value)
+		}
+	}
+	for _, f := range []struct {
+		name  string
+		value int
+	}{
+		{"cpus", m.CPUs},
+		{"memory", m.Memory},
+		{"parallelism", m.Parallelism},
+	} {
+		if f.value > 0 {
+			globalArgs = append(globalArgs, "--"+f.name+"="+strconv.Itoa(f.value))
+		}
+	}
+	otherArgs, err := flagArgs(m.Flags)
+	if err != nil {
+		return
+	}
+	globalArgs = append(globalArgs, otherArgs...)
+
+	jobArgs, err = flagArgs(m.Job.Flags)
+	if err != nil {
+		return
+	}
+	jobArgs = append([]string{m.Job.Name}, jobArgs...)
+	for _, img := range m.Images {
+		jobArgs = append(jobArgs, "--image="+img.spec())
+	}
+	return
+}
+
+// withoutFlags returns args, in the "--name=value" form, without the ones of the flags for which isSet is true
+func withoutFlags(args []string, isSet func(name string) bool) []string {
+	var res []string
+	for _, a := range args {
+		name := strings.SplitN(strings.TrimPrefix(a, "--"), "=", 2)[0]
+		if !isSet(name) {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+func runManifest(c *cli.Context) error {
+	m, err := loadManifest(c.String("file"))
+	if err != nil {
+		return err
+	}
+
+	if len(m.PluginDir) > 0 && !c.GlobalIsSet("plugin-dir") {
+		err = vmjobs.LoadPlugins(m.PluginDir)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	manifestGlobalArgs, jobArgs, err := m.args()
+	if err != nil {
+		return fmt.Errorf("%s: %s", c.String("file"), err)
+	}
+
+	// Global flags from the command line come last, to take precedence.
+	// They are whatever precedes the "run" command in the original arguments.
+	// Flags accepting multiple values would add up to the manifest ones, which are left out instead.
+	cmdArgs := c.Parent().Args()
+	globalArgs := os.Args[1 : len(os.Args)-len(cmdArgs)]
+	manifestGlobalArgs = withoutFlags(manifestGlobalArgs, c.GlobalIsSet)
+
+	args := []string{os.Args[0]}
+	args = append(args, manifestGlobalArgs...)
+	args = append(args, globalArgs...)
+	args = append(args, jobArgs...)
+	log.Debugf("Running manifest '%s' as: %s", c.String("file"), strings.Join(args, " "))
+	return newApp().Run(args)
+}
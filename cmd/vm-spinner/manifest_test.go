@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifestArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		yaml       string
+		wantGlobal []string
+		wantJob    []string
+		wantErr    bool
+	}{
+		{
+			name:    "minimal",
+			yaml:    "job:\n  name: cmd\nimages:\n  - ubuntu/focal64\n",
+			wantJob: []string{"cmd", "--image=ubuntu/focal64"},
+		},
+		{
+			name: "full",
+			yaml: `backend: qemu
+cpus: 2
+memory: 4096
+parallelism: 3
+flags:
+  qemu.image-dir: /images
+  keep-on-failure: true
+job:
+  name: cmd
+  flags:
+    line: uname -r
+    provision: [apk update, apk add gcc]
+images:
+  - alpine:cpus=1
+  - name: ubuntu/focal64
+    memory: 8192
+`,
+			wantGlobal: []string{"--backend=qemu", "--cpus=2", "--memory=4096", "--parallelism=3",
+				"--keep-on-failure=true", "--qemu.image-dir=/images"},
+			wantJob: []string{"cmd", "--line=uname -r", "--provision=apk update", "--provision=apk add gcc",
+				"--image=alpine:cpus=1", "--image=ubuntu/focal64:mem=8192"},
+		},
+		{
+			name:    "missing flag value",
+			yaml:    "job:\n  name: cmd\n  flags:\n    line:\n",
+			wantErr: true,
+		},
+		{
+			name:    "nested flag value",
+			yaml:    "job:\n  name: cmd\nflags:\n  backend:\n    name: qemu\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "manifest.yaml")
+		if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := loadManifest(path)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		global, job, err := m.args()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v %v", tt.name, global, job)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(global, tt.wantGlobal) {
+			t.Errorf("%s: global args %q, expected %q", tt.name, global, tt.wantGlobal)
+		}
+		if !reflect.DeepEqual(job, tt.wantJob) {
+			t.Errorf("%s: job args %q, expected %q", tt.name, job, tt.wantJob)
+		}
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+	}{
+		{"missing job", "images:\n  - ubuntu/focal64\n"},
+		{"unknown field", "job:\n  name: cmd\nimage: ubuntu/focal64\n"},
+		{"wrong image", "job:\n  name: cmd\nimages:\n  - ubuntu/focal64:cpus=none\n"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "manifest.yaml")
+		if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadManifest(path); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestManifestArgsOverridden(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.yaml")
+	yaml := "backend: qemu\ncpus: 2\nflags:\n  var: [a=1, b=2]\njob:\n  name: cmd\n"
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	global, _, err := m.args()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		set  []string
+		want []string
+	}{
+		{"none set", nil, []string{"--backend=qemu", "--cpus=2", "--var=a=1", "--var=b=2"}},
+		{"multiple values", []string{"var"}, []string{"--backend=qemu", "--cpus=2"}},
+		{"single value", []string{"cpus"}, []string{"--backend=qemu", "--var=a=1", "--var=b=2"}},
+	}
+	for _, tt := range tests {
+		isSet := func(name string) bool {
+			for _, s := range tt.set {
+				if s == name {
+					return true
+				}
+			}
+			return false
+		}
+		if got := withoutFlags(global, isSet); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: global args %q, expected %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs"
+	"sync"
+
+	"github.com/urfave/cli"
+)
+
+// Exit codes of runs that failed according to the "fail-on" policy.
+// Infrastructure failures (eg: a VM that did not boot) take precedence over job ones,
+// which take precedence over cancellations (eg: by a signal), whatever the policy.
+const (
+	exitCodeInfraFailure = 2
+	exitCodeJobFailure   = 3
+	exitCodeCancelled    = 4
+)
+
+const (
+	failOnAny  = "any"
+	failOnAll  = "all"
+	failOnNone = "none"
+)
+
+// runSummary aggregates the results of all the VMs of a run, from any worker goroutine
+type runSummary struct {
+	mu sync.Mutex
+	// total -> number of VMs of the run, including the ones never started (eg: cancelled by --fail-fast)
+	total int
+	// started -> number of VMs whose result was added
+	started     int
+	infraFailed int
+	jobFailed   int
+	cancelled   int
+	kept        []*vmjobs.VMResult
+}
+
+func validateFailOn(policy string) error {
+	switch policy {
+	case failOnAny, failOnAll, failOnNone:
+		return nil
+	}
+	return fmt.Errorf("wrong fail-on policy '%s', between { %s, %s, %s }", policy, failOnAny, failOnAll, failOnNone)
+}
+
+func (s *runSummary) add(res *vmjobs.VMResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started++
+	if len(res.KeptPath) > 0 {
+		s.kept = append(s.kept, res)
+	}
+	switch {
+	case !res.Failed():
+		return
+	case res.Status == vmjobs.VMStatusCancelled:
+		s.cancelled++
+	case res.FailedPhase == vmjobs.VMPhaseJob:
+		s.jobFailed++
+	default:
+		s.infraFailed++
+	}
+}
+
+// printKept prints where the VMs kept alive are, and how to get into them
+func (s *runSummary) printKept() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.kept) == 0 {
+		return
+	}
+	fmt.Printf("%d VMs kept alive, destroy them with 'vm-spinner cleanup':\n", len(s.kept))
+	for _, res := range s.kept {
+		fmt.Printf("  %s (%s): %s\n", res.VM, res.Summary(), res.KeptPath)
+		if len(res.ShellCmd) > 0 {
+			fmt.Printf("    %s\n", res.ShellCmd)
+		}
+	}
+}
+
+// exitErr returns an error carrying the exit code of the run, if it failed according to policy,
+// or if it was cancelled before all of its VMs finished
+func (s *runSummary) exitErr(policy string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failed := s.infraFailed + s.jobFailed
+	// cancelled VMs, and the ones never started, did not finish, thus they neither failed nor succeeded
+	skipped := s.total - s.started
+	finished := s.started - s.cancelled
+	failing := false
+	switch policy {
+	case failOnAny:
+		failing = failed > 0
+	case failOnAll:
+		failing = failed > 0 && failed == finished
+	}
+	if !failing && s.cancelled == 0 && skipped == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%d of %d VMs failed (%d infrastructure failures, %d job failures, %d cancelled, %d never started)",
+		failed, s.total, s.infraFailed, s.jobFailed, s.cancelled, skipped)
+	switch {
+	case failing && s.infraFailed > 0:
+		return cli.NewExitError(msg, exitCodeInfraFailure)
+	case failing:
+		return cli.NewExitError(msg, exitCodeJobFailure)
+	default:
+		return cli.NewExitError(msg, exitCodeCancelled)
+	}
+}
@@ -1,13 +1,19 @@
 module github.com/jasondellaluce/experiments/vm-spinner
 
-go 1.16
+go 1.20
 
 require (
-	github.com/hashicorp/go-version v1.3.0 // indirect
-	github.com/koding/logging v0.0.0-20160720134017-8b5a689ed69b // indirect
-	github.com/koding/vagrantutil v0.0.0-20180710063911-70827343f116
 	github.com/olekukonko/tablewriter v0.0.5
 	github.com/sirupsen/logrus v1.8.1
 	github.com/urfave/cli v1.22.5
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
+	github.com/mattn/go-runewidth v0.0.9 // indirect
+	github.com/russross/blackfriday/v2 v2.0.1 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
 )
@@ -0,0 +1,163 @@
+package scheduler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// File the host memory is read from
+const meminfoFile = "/proc/meminfo"
+
+// Minimum memory (in MB) given to VMs, whatever the memory available
+const minMemory = 1
+
+// Resources -> what a VM takes from the host, or what the host can give to VMs
+type Resources struct {
+	CPUs int
+	// Memory -> in MB, as the "memory" flag
+	Memory int
+}
+
+// HostCapacity returns the CPUs of the host, and the memory available when called minus reserve.
+// Memory is 0 if it can't be known, eg: on hosts without /proc/meminfo. If the memory available does not
+// exceed reserve (eg: as concurrent runs eat into it), memory is clamped to the minimum instead, so that
+// VMs still run, one at a time (see Acquire).
+func HostCapacity(reserve int) (Resources, error) {
+	capacity := Resources{CPUs: runtime.NumCPU()}
+	f, err := os.Open(meminfoFile)
+	if os.IsNotExist(err) {
+		return capacity, nil
+	}
+	if err != nil {
+		return capacity, err
+	}
+	defer f.Close()
+
+	// MemAvailable accounts for what is already used, eg: by VMs of concurrent runs
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return capacity, fmt.Errorf("%s: wrong MemAvailable value '%s'", meminfoFile, fields[1])
+		}
+		capacity.Memory = kb/1024 - reserve
+		if capacity.Memory < minMemory {
+			capacity.Memory = minMemory
+		}
+		return capacity, scanner.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return capacity, err
+	}
+	return capacity, fmt.Errorf("%s: MemAvailable not found", meminfoFile)
+}
+
+// Scheduler -> admits VMs as long as the resources they need fit in the host capacity,
+// and no more than a given number of them at once. VMs are admitted in the order they asked.
+type Scheduler struct {
+	capacity Resources
+	slots    *semaphore.Weighted
+	cpus     *semaphore.Weighted
+	memory   *semaphore.Weighted
+}
+
+// New returns a scheduler admitting up to parallelism VMs within capacity.
+// Memory is not accounted for if capacity has none.
+func New(capacity Resources, parallelism int) *Scheduler {
+	s := &Scheduler{
+		capacity: capacity,
+		slots:    semaphore.NewWeighted(int64(parallelism)),
+		cpus:     semaphore.NewWeighted(int64(capacity.CPUs)),
+	}
+	if capacity.Memory > 0 {
+		s.memory = semaphore.NewWeighted(int64(capacity.Memory))
+	}
+	return s
+}
+
+// Capacity returns the resources shared by the VMs
+func (s *Scheduler) Capacity() Resources {
+	return s.capacity
+}
+
+// Fits returns an error if a VM needing r would never be admitted, as its CPUs exceed the capacity
+func (s *Scheduler) Fits(r Resources) error {
+	if r.CPUs > s.capacity.CPUs {
+		return fmt.Errorf("%d CPUs exceed the CPUs available (%d)", r.CPUs, s.capacity.CPUs)
+	}
+	return nil
+}
+
+// Alone returns whether a VM needing r only runs alone, as its memory exceeds the capacity
+func (s *Scheduler) Alone(r Resources) bool {
+	return s.memory != nil && r.Memory > s.capacity.Memory
+}
+
+// Acquire waits for a VM needing r to be admitted, or for ctx to be done.
+// A VM needing more memory than the capacity waits for all of it, thus runs alone.
+// On success, the VM must call Release with the same r once gone.
+func (s *Scheduler) Acquire(ctx context.Context, r Resources) error {
+	err := s.Fits(r)
+	if err != nil {
+		return err
+	}
+	err = s.slots.Acquire(ctx, 1)
+	if err != nil {
+		return err
+	}
+	err = s.cpus.Acquire(ctx, int64(r.CPUs))
+	if err != nil {
+		s.slots.Release(1)
+		return err
+	}
+	err = s.AcquireMemory(ctx, r.Memory)
+	if err != nil {
+		s.cpus.Release(int64(r.CPUs))
+		s.slots.Release(1)
+		return err
+	}
+	return nil
+}
+
+// Release gives back the resources of a VM admitted by Acquire
+func (s *Scheduler) Release(r Resources) {
+	s.ReleaseMemory(r.Memory)
+	s.cpus.Release(int64(r.CPUs))
+	s.slots.Release(1)
+}
+
+// AcquireMemory waits for memory (in MB) to be available, or for ctx to be done, as Acquire does.
+// It lets VMs admitted without memory take it later, eg: once they are known to need it.
+// On success, the VM must call ReleaseMemory with the same memory once gone.
+func (s *Scheduler) AcquireMemory(ctx context.Context, memory int) error {
+	if s.memory == nil {
+		return nil
+	}
+	return s.memory.Acquire(ctx, s.memoryWeight(memory))
+}
+
+// ReleaseMemory gives back memory taken by AcquireMemory
+func (s *Scheduler) ReleaseMemory(memory int) {
+	if s.memory != nil {
+		s.memory.Release(s.memoryWeight(memory))
+	}
+}
+
+// memoryWeight returns how much of the memory semaphore a VM needing memory takes
+func (s *Scheduler) memoryWeight(memory int) int64 {
+	if memory > s.capacity.Memory {
+		return int64(s.capacity.Memory)
+	}
+	return int64(memory)
+}
@@ -0,0 +1,63 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSchedulerFits(t *testing.T) {
+	tests := []struct {
+		name      string
+		capacity  Resources
+		r         Resources
+		wantErr   bool
+		wantAlone bool
+	}{
+		{"fits", Resources{CPUs: 4, Memory: 8192}, Resources{CPUs: 2, Memory: 4096}, false, false},
+		{"takes all", Resources{CPUs: 4, Memory: 8192}, Resources{CPUs: 4, Memory: 8192}, false, false},
+		{"too many CPUs", Resources{CPUs: 4, Memory: 8192}, Resources{CPUs: 5, Memory: 1024}, true, false},
+		{"too much memory", Resources{CPUs: 4, Memory: 8192}, Resources{CPUs: 1, Memory: 8193}, false, true},
+		{"unknown memory", Resources{CPUs: 4}, Resources{CPUs: 2, Memory: 1 << 20}, false, false},
+	}
+	for _, tt := range tests {
+		s := New(tt.capacity, 1)
+		err := s.Fits(tt.r)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Fits(%+v) = %v, expected error: %v", tt.name, tt.r, err, tt.wantErr)
+		}
+		if alone := s.Alone(tt.r); alone != tt.wantAlone {
+			t.Errorf("%s: Alone(%+v) = %v, expected %v", tt.name, tt.r, alone, tt.wantAlone)
+		}
+	}
+}
+
+func TestSchedulerAcquireAlone(t *testing.T) {
+	s := New(Resources{CPUs: 4, Memory: 1024}, 4)
+	small := Resources{CPUs: 1, Memory: 512}
+	big := Resources{CPUs: 1, Memory: 4096}
+
+	if err := s.Acquire(context.Background(), small); err != nil {
+		t.Fatal(err)
+	}
+	// The big VM waits for the small one to be gone, then holds back all the others
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Acquire(ctx, big); err == nil {
+		t.Fatal("big VM admitted along with another one")
+	}
+	s.Release(small)
+	if err := s.Acquire(context.Background(), big); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.AcquireMemory(ctx, small.Memory); err == nil {
+		t.Fatal("memory admitted along with the big VM")
+	}
+	s.Release(big)
+	if err := s.AcquireMemory(context.Background(), small.Memory); err != nil {
+		t.Fatal(err)
+	}
+	s.ReleaseMemory(small.Memory)
+}
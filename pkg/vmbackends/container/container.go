@@ -0,0 +1,265 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"github.com/urfave/cli"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Well known Vagrant boxes, and the container image with the same userland
+var defaultImages = map[string]string{
+	"ubuntu/xenial64":     "ubuntu:16.04",
+	"ubuntu/bionic64":     "ubuntu:18.04",
+	"ubuntu/focal64":      "ubuntu:20.04",
+	"ubuntu/jammy64":      "ubuntu:22.04",
+	"generic/debian10":    "debian:10",
+	"generic/debian11":    "debian:11",
+	"generic/fedora33":    "fedora:33",
+	"generic/fedora35":    "fedora:35",
+	"generic/centos7":     "centos:7",
+	"generic/centos8":     "centos:8",
+	"bento/amazonlinux-2": "amazonlinux:2",
+	"generic/alpine314":   "alpine:3.14",
+	"generic/arch":        "archlinux:latest",
+}
+
+// File in the VM path storing what is needed to reattach to the container
+const stateFile = "container.json"
+
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+type containerBackend struct {
+	runtime string
+	images  map[string]string
+}
+
+type containerVM struct {
+	conf    *vmbackends.VMConfig
+	Runtime string `json:"runtime"`
+	Name    string `json:"name"`
+}
+
+func init() {
+	b := &containerBackend{}
+	_ = vmbackends.RegisterBackend(b.String(), b)
+}
+
+func (b *containerBackend) String() string {
+	return "container"
+}
+
+func (b *containerBackend) Desc() string {
+	return "Run jobs in docker or podman containers. Containers share the host kernel, thus kernel dependent jobs can't run on them."
+}
+
+func (b *containerBackend) Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "container.runtime",
+			Usage: "Container runtime used by the container backend, between { docker, podman }.",
+			Value: "docker",
+		},
+		cli.StringSliceFlag{
+			Name: "container.image",
+			Usage: "Map an image name to a container image, in the 'name=container-image' form. Specify it multiple times for multiple images. " +
+				"Well known Vagrant boxes (eg: 'ubuntu/focal64') are mapped by default, other names are used as they are.",
+		},
+	}
+}
+
+func (b *containerBackend) ParseCfg(c *cli.Context) error {
+	b.runtime = c.GlobalString("container.runtime")
+	if b.runtime != "docker" && b.runtime != "podman" {
+		return fmt.Errorf("unsupported container runtime '%s'", b.runtime)
+	}
+	if _, err := exec.LookPath(b.runtime); err != nil {
+		return err
+	}
+
+	b.images = make(map[string]string)
+	for k, v := range defaultImages {
+		b.images[k] = v
+	}
+	for _, m := range c.GlobalStringSlice("container.image") {
+		kv := strings.SplitN(m, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return fmt.Errorf("wrong container image mapping '%s', expected 'name=container-image'", m)
+		}
+		b.images[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+// SharesHostKernel is always true, containers run on the host kernel
+func (b *containerBackend) SharesHostKernel() bool {
+	return true
+}
+
+// SharesHostMemory is always true, the memory of containers is a limit, not a reservation
+func (b *containerBackend) SharesHostMemory() bool {
+	return true
+}
+
+func (b *containerBackend) image(boxName string) string {
+	if img, ok := b.images[boxName]; ok {
+		return img
+	}
+	return boxName
+}
+
+func (b *containerBackend) Create(ctx context.Context, conf *vmbackends.VMConfig, info chan<- string) (vmbackends.VM, error) {
+	err := os.MkdirAll(conf.Path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	image := b.image(conf.BoxName)
+	if conf.Snapshot != nil {
+		image = snapshotImage(conf.Snapshot)
+	} else {
+		vmbackends.SendStr(info, "Pulling container image '"+image+"'")
+		err = vmbackends.RunCmd(exec.CommandContext(ctx, b.runtime, "pull", image), info)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	name := invalidNameChars.ReplaceAllString(fmt.Sprintf("vm-spinner-%d-%s", os.Getpid(), filepath.Base(conf.Path)), "_")
+	args := []string{
+		"create",
+		"--name", name,
+		"--cpus", strconv.Itoa(conf.CPUs),
+		"--memory", strconv.Itoa(conf.Memory) + "m",
+		"--entrypoint", "",
+		image,
+		"tail", "-f", "/dev/null",
+	}
+	err = vmbackends.RunCmd(exec.CommandContext(ctx, b.runtime, args...), info)
+	if err != nil {
+		return nil, err
+	}
+	vm := &containerVM{conf: conf, Runtime: b.runtime, Name: name}
+	data, err := json.Marshal(vm)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(conf.Path, stateFile), data, 0644)
+	}
+	if err != nil {
+		_ = vm.Destroy(context.Background(), info)
+		return nil, err
+	}
+	return vm, nil
+}
+
+func (b *containerBackend) Load(ctx context.Context, conf *vmbackends.VMConfig) (vmbackends.VM, error) {
+	data, err := os.ReadFile(filepath.Join(conf.Path, stateFile))
+	if err != nil {
+		return nil, err
+	}
+	vm := &containerVM{conf: conf}
+	err = json.Unmarshal(data, vm)
+	if err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// snapshotImage returns the name of the image s is committed to
+func snapshotImage(s *vmbackends.Snapshot) string {
+	return "vm-spinner/" + s.Name
+}
+
+// DeleteSnapshot removes the image s is committed to, with the runtime that committed it
+func (b *containerBackend) DeleteSnapshot(ctx context.Context, s *vmbackends.Snapshot, info chan<- string) error {
+	data, err := os.ReadFile(filepath.Join(s.Dir, stateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	vm := &containerVM{}
+	err = json.Unmarshal(data, vm)
+	if err != nil {
+		return err
+	}
+	return vm.run(ctx, info, "rmi", "--force", snapshotImage(s))
+}
+
+// Snapshot commits the container to a new image
+func (v *containerVM) Snapshot(ctx context.Context, s *vmbackends.Snapshot, info chan<- string) error {
+	err := v.run(ctx, info, "commit", v.Name, snapshotImage(s))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.Dir, stateFile), data, 0644)
+}
+
+func (v *containerVM) ShellCmd() string {
+	return v.Runtime + " exec -it " + v.Name + " sh"
+}
+
+func (v *containerVM) Boot(ctx context.Context, info chan<- string) error {
+	return v.run(ctx, info, "start", v.Name)
+}
+
+func (v *containerVM) Exec(ctx context.Context, cmd string, output chan<- string) error {
+	return v.run(ctx, output, "exec", v.Name, "sh", "-c", cmd)
+}
+
+func (v *containerVM) ExecStreams(ctx context.Context, cmd string, stdout, stderr chan<- string) error {
+	return vmbackends.RunCmdStreams(exec.CommandContext(ctx, v.Runtime, "exec", v.Name, "sh", "-c", cmd), stdout, stderr)
+}
+
+// Copy resolves a relative dst from the working directory of the commands, as "cp" resolves it from the container root
+func (v *containerVM) Copy(ctx context.Context, src, dst string, info chan<- string) error {
+	if !path.IsAbs(dst) {
+		wd, err := v.workDir(ctx)
+		if err != nil {
+			return err
+		}
+		dst = path.Join(wd, dst)
+	}
+	return v.run(ctx, info, "cp", src, v.Name+":"+dst)
+}
+
+func (v *containerVM) Download(ctx context.Context, src, dst string, info chan<- string) error {
+	return v.run(ctx, info, "cp", v.Name+":"+src, dst)
+}
+
+func (v *containerVM) Halt(ctx context.Context, info chan<- string) error {
+	return v.run(ctx, info, "stop", v.Name)
+}
+
+func (v *containerVM) Destroy(ctx context.Context, info chan<- string) error {
+	err := v.run(ctx, info, "rm", "--force", v.Name)
+	if rmErr := os.RemoveAll(v.conf.Path); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// workDir returns the working directory of the commands run in the container
+func (v *containerVM) workDir(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, v.Runtime, "exec", v.Name, "pwd").Output()
+	if err != nil {
+		return "", fmt.Errorf("can't get the working directory of the container: %s", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (v *containerVM) run(ctx context.Context, output chan<- string, args ...string) error {
+	return vmbackends.RunCmd(exec.CommandContext(ctx, v.Runtime, args...), output)
+}
@@ -0,0 +1,44 @@
+package container
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+)
+
+func TestContainerCopy(t *testing.T) {
+	// Stub runtime recording its arguments, running commands from /home/builder
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	runtime := filepath.Join(dir, "docker")
+	script := "#!/bin/sh\necho \"$@\" > " + calls + "\n[ \"$1 $3\" = \"exec pwd\" ] && echo /home/builder\nexit 0\n"
+	if err := os.WriteFile(runtime, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	vm := &containerVM{conf: &vmbackends.VMConfig{Path: dir}, Runtime: runtime, Name: "vm"}
+
+	tests := []struct {
+		dst  string
+		want string
+	}{
+		{"libs", "cp /src vm:/home/builder/libs"},
+		{"./build/libs", "cp /src vm:/home/builder/build/libs"},
+		{"/opt/libs", "cp /src vm:/opt/libs"},
+	}
+	for _, tt := range tests {
+		if err := vm.Copy(context.Background(), "/src", tt.dst, nil); err != nil {
+			t.Fatalf("%s: %s", tt.dst, err)
+		}
+		out, err := os.ReadFile(calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(out)); got != tt.want {
+			t.Errorf("%s: runtime called with '%s', expected '%s'", tt.dst, got, tt.want)
+		}
+	}
+}
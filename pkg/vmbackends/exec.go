@@ -0,0 +1,69 @@
+package vmbackends
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Grace period for the output of a cancelled command to be closed, since
+// its children (eg: a shell script) might keep it open after it gets killed
+const cancelWaitDelay = time.Second
+
+// RunCmd runs c until completion, sending each line of its stdout and stderr to output
+func RunCmd(c *exec.Cmd, output chan<- string) error {
+	return RunCmdStreams(c, output, output)
+}
+
+// RunCmdStreams runs c until completion, sending each line of its stdout and stderr to the respective channel.
+// If they are the same channel, lines are sent in the order they were printed.
+func RunCmdStreams(c *exec.Cmd, stdout, stderr chan<- string) error {
+	if c.WaitDelay == 0 {
+		c.WaitDelay = cancelWaitDelay
+	}
+	var scans sync.WaitGroup
+	pipe := func(output chan<- string) *io.PipeWriter {
+		pr, pw := io.Pipe()
+		scans.Add(1)
+		go func() {
+			scanner := bufio.NewScanner(pr)
+			for scanner.Scan() {
+				SendStr(output, scanner.Text())
+			}
+			// Unblock the command in case of scanner errors
+			_, _ = io.Copy(io.Discard, pr)
+			scans.Done()
+		}()
+		return pw
+	}
+	outPipe := pipe(stdout)
+	errPipe := outPipe
+	if stderr != stdout {
+		errPipe = pipe(stderr)
+	}
+	c.Stdout = outPipe
+	c.Stderr = errPipe
+
+	err := c.Run()
+	outPipe.Close()
+	errPipe.Close()
+	scans.Wait()
+	return err
+}
+
+// ExecStreams runs cmd in vm, sending its stdout and stderr lines to the respective channel if vm can tell them apart
+func ExecStreams(ctx context.Context, vm VM, cmd string, stdout, stderr chan<- string) error {
+	if s, ok := vm.(VMStreamer); ok {
+		return s.ExecStreams(ctx, cmd, stdout, stderr)
+	}
+	return vm.Exec(ctx, cmd, stdout)
+}
+
+// ShellQuote quotes s to be used as a single word in a shell command line
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,272 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"github.com/urfave/cli"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Responder is called for each command sent to a fake VM, in place of actually running it.
+// It is expected to send the command output lines to output, and to return as soon as possible once ctx is done.
+type Responder func(ctx context.Context, VM, cmd string, output chan<- string) error
+
+const (
+	// Folder of the snapshots, containing a copy of the VM directory
+	snapshotDir = "vm"
+	// Suffix of the folder next to the VM directory, containing its copy taken by Checkpoint
+	checkpointSuffix = ".checkpoint"
+)
+
+type fakeBackend struct {
+	shell        string
+	responder    Responder
+	bootFailures int
+
+	mu sync.Mutex
+	// failedBoots -> number of boots that failed on purpose so far, for each VM path
+	failedBoots map[string]int
+}
+
+type fakeVM struct {
+	backend *fakeBackend
+	conf    *vmbackends.VMConfig
+}
+
+func init() {
+	b := &fakeBackend{}
+	_ = vmbackends.RegisterBackend(b.String(), b)
+}
+
+// New returns a fake backend that answers to every command through responder.
+// It is meant to test jobs without any real VM.
+func New(responder Responder) vmbackends.VMBackend {
+	return &fakeBackend{responder: responder}
+}
+
+func (b *fakeBackend) String() string {
+	return "fake"
+}
+
+func (b *fakeBackend) Desc() string {
+	return "Run commands on the local host, in place of real VMs. Useful for testing jobs."
+}
+
+func (b *fakeBackend) Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "fake.shell",
+			Usage: "Local shell used by the fake backend to run commands.",
+			Value: "/bin/sh",
+		},
+		cli.StringFlag{
+			Name:  "fake.responses",
+			Usage: "File whose lines are sent back as output for each command by the fake backend, instead of running it.",
+		},
+		cli.IntFlag{
+			Name:  "fake.boot-failures",
+			Usage: "Number of times the boot of each VM fails with a transient error, before succeeding. Useful to test boot retries.",
+		},
+	}
+}
+
+func (b *fakeBackend) ParseCfg(c *cli.Context) error {
+	b.shell = c.GlobalString("fake.shell")
+	b.bootFailures = c.GlobalInt("fake.boot-failures")
+	b.failedBoots = make(map[string]int)
+	if c.GlobalIsSet("fake.responses") {
+		data, err := os.ReadFile(c.GlobalString("fake.responses"))
+		if err != nil {
+			return err
+		}
+		b.responder = ScriptedResponder(strings.Split(strings.TrimRight(string(data), "\n"), "\n"))
+	}
+	return nil
+}
+
+// SharesHostMemory is always true, commands run as local processes
+func (b *fakeBackend) SharesHostMemory() bool {
+	return true
+}
+
+// localShell returns the shell to run commands with, ParseCfg is not called when created with New
+func (b *fakeBackend) localShell() string {
+	if len(b.shell) == 0 {
+		return "/bin/sh"
+	}
+	return b.shell
+}
+
+func (b *fakeBackend) Create(ctx context.Context, conf *vmbackends.VMConfig, info chan<- string) (vmbackends.VM, error) {
+	vmbackends.SendStr(info, "Creating fake VM directory '"+conf.Path+"'")
+	err := os.MkdirAll(conf.Path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Snapshot != nil {
+		err = copyDir(ctx, filepath.Join(conf.Snapshot.Dir, snapshotDir), conf.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &fakeVM{backend: b, conf: conf}, nil
+}
+
+// DeleteSnapshot does nothing, fake snapshots are entirely in their folder
+func (b *fakeBackend) DeleteSnapshot(ctx context.Context, s *vmbackends.Snapshot, info chan<- string) error {
+	return nil
+}
+
+// Snapshot saves the content of the VM directory
+func (v *fakeVM) Snapshot(ctx context.Context, s *vmbackends.Snapshot, info chan<- string) error {
+	dst := filepath.Join(s.Dir, snapshotDir)
+	err := os.RemoveAll(dst)
+	if err == nil {
+		err = os.MkdirAll(dst, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	return copyDir(ctx, v.conf.Path, dst)
+}
+
+func (b *fakeBackend) Load(ctx context.Context, conf *vmbackends.VMConfig) (vmbackends.VM, error) {
+	if _, err := os.Stat(conf.Path); err != nil {
+		return nil, err
+	}
+	return &fakeVM{backend: b, conf: conf}, nil
+}
+
+func (v *fakeVM) ShellCmd() string {
+	return "cd " + vmbackends.ShellQuote(v.conf.Path) + " && " + v.backend.localShell()
+}
+
+func (v *fakeVM) Boot(ctx context.Context, info chan<- string) error {
+	v.backend.mu.Lock()
+	failed := v.backend.failedBoots[v.conf.Path] < v.backend.bootFailures
+	if failed {
+		v.backend.failedBoots[v.conf.Path]++
+	}
+	v.backend.mu.Unlock()
+	if failed {
+		return fmt.Errorf("fake VM for '%s' failed to boot: connection reset by peer", v.conf.BoxName)
+	}
+
+	vmbackends.SendStr(info, "Fake VM for '"+v.conf.BoxName+"' is up")
+	return nil
+}
+
+// Exec runs cmd with the local shell from the VM directory, unless a responder is set
+func (v *fakeVM) Exec(ctx context.Context, cmd string, output chan<- string) error {
+	return v.ExecStreams(ctx, cmd, output, output)
+}
+
+// ExecStreams runs cmd as Exec, responders only send lines to stdout
+func (v *fakeVM) ExecStreams(ctx context.Context, cmd string, stdout, stderr chan<- string) error {
+	if v.backend.responder != nil {
+		return v.backend.responder(ctx, v.conf.BoxName, cmd, stdout)
+	}
+
+	c := exec.CommandContext(ctx, v.backend.localShell(), "-c", cmd)
+	c.Dir = v.conf.Path
+	return vmbackends.RunCmdStreams(c, stdout, stderr)
+}
+
+// Copy copies src into the VM directory, treating dst as relative to it
+func (v *fakeVM) Copy(ctx context.Context, src, dst string, info chan<- string) error {
+	dst = filepath.Join(v.conf.Path, dst)
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	out, err := exec.CommandContext(ctx, "cp", "-R", src, dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	vmbackends.SendStr(info, "Copied '"+src+"' to '"+dst+"'")
+	return nil
+}
+
+// Download copies src from the local host, as that is where commands run. Fake VMs answering
+// with a responder have no files, thus nothing is downloaded from them.
+func (v *fakeVM) Download(ctx context.Context, src, dst string, info chan<- string) error {
+	if v.backend.responder != nil {
+		vmbackends.SendStr(info, "Not downloading '"+src+"', fake VM answering with responses")
+		return nil
+	}
+	out, err := exec.CommandContext(ctx, "cp", "-R", src, dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	return nil
+}
+
+func (v *fakeVM) Halt(ctx context.Context, info chan<- string) error {
+	vmbackends.SendStr(info, "Fake VM for '"+v.conf.BoxName+"' is down")
+	return nil
+}
+
+// Checkpoint saves a copy of the VM directory
+func (v *fakeVM) Checkpoint(ctx context.Context, info chan<- string) error {
+	dst := v.conf.Path + checkpointSuffix
+	err := os.RemoveAll(dst)
+	if err == nil {
+		err = os.MkdirAll(dst, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	return copyDir(ctx, v.conf.Path, dst)
+}
+
+// Reset replaces the content of the VM directory with the copy saved by Checkpoint
+func (v *fakeVM) Reset(ctx context.Context, info chan<- string) error {
+	err := os.RemoveAll(v.conf.Path)
+	if err == nil {
+		err = os.MkdirAll(v.conf.Path, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	vmbackends.SendStr(info, "Resetting fake VM for '"+v.conf.BoxName+"'")
+	return copyDir(ctx, v.conf.Path+checkpointSuffix, v.conf.Path)
+}
+
+func (v *fakeVM) Destroy(ctx context.Context, info chan<- string) error {
+	err := os.RemoveAll(v.conf.Path + checkpointSuffix)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(v.conf.Path)
+}
+
+// copyDir copies the content of src into dst
+func copyDir(ctx context.Context, src, dst string) error {
+	out, err := exec.CommandContext(ctx, "cp", "-R", src+"/.", dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	return nil
+}
+
+// ScriptedResponder returns a Responder that sends back lines for every command
+func ScriptedResponder(lines []string) Responder {
+	return func(ctx context.Context, VM, cmd string, output chan<- string) error {
+		if output == nil {
+			return ctx.Err()
+		}
+		for _, l := range lines {
+			select {
+			case output <- l:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+}
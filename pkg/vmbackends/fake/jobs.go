@@ -0,0 +1,64 @@
+package fake
+
+import (
+	"context"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs"
+	"path/filepath"
+	"sort"
+)
+
+// RunJob runs job on a fake VM of image in the folder path, answering with responder, and feeds the job with the VM output
+// and result as vm-spinner does, if it processes them. It returns once the VM is gone, without calling the Done of the job.
+// It is meant to test jobs end to end.
+func RunJob(ctx context.Context, responder Responder, job vmjobs.VMJob, image, path string) *vmjobs.VMResult {
+	conf := &vmbackends.VMConfig{Path: path, BoxName: image, Job: job}
+	channels := vmbackends.RunVirtualMachine(ctx, New(responder), conf)
+	processor, isProcessor := vmjobs.LineProcessor(job)
+	output, debug, info, errs := channels.CmdOutput, channels.Debug, channels.Info, channels.Error
+	for output != nil || debug != nil || info != nil || errs != nil {
+		select {
+		case l, ok := <-output:
+			if !ok {
+				output = nil
+				continue
+			}
+			if isProcessor {
+				processor.ProcessLine(image, l)
+			}
+		case _, ok := <-debug:
+			if !ok {
+				debug = nil
+			}
+		case _, ok := <-info:
+			if !ok {
+				info = nil
+			}
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+		}
+	}
+	res := <-channels.Done
+	if p, ok := job.(vmjobs.VMJobResultProcessor); ok {
+		p.ProcessResult(res)
+	}
+	return res
+}
+
+// RunJobs runs job as RunJob on a fake VM for each image of responders, answering with its responder,
+// one after the other in folders of dir. It returns the result of each image.
+func RunJobs(ctx context.Context, job vmjobs.VMJob, dir string, responders map[string]Responder) map[string]*vmjobs.VMResult {
+	var images []string
+	for image := range responders {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	results := make(map[string]*vmjobs.VMResult)
+	for _, image := range images {
+		results[image] = RunJob(ctx, responders[image], job, image, filepath.Join(dir, image))
+	}
+	return results
+}
@@ -0,0 +1,428 @@
+package firecracker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends/sshutil"
+	"github.com/urfave/cli"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	configFile  = "config.json"
+	rootfsFile  = "rootfs.ext4"
+	kernelFile  = "vmlinux"
+	consoleFile = "console.log"
+	stateFile   = "state.json"
+	pidFile     = "firecracker.pid"
+
+	// Each VM gets a /30 subnet out of 172.30.0.0/16, one per tap device
+	maxTaps    = 1 << 14
+	tapPrefix  = "vmsfc"
+	guestMask  = "255.255.255.252"
+	bootArgFmt = "console=ttyS0 reboot=k panic=1 pci=off ip=%s::%s:" + guestMask + "::eth0:off"
+
+	haltWaitTimeout = 30 * time.Second
+)
+
+type firecrackerBackend struct {
+	binary   string
+	imageDir string
+	user     string
+	sshKey   string
+}
+
+type firecrackerVM struct {
+	backend *firecrackerBackend
+	conf    *vmbackends.VMConfig
+	kernel  string
+	tap     string
+	ssh     sshutil.Target
+	cmd     *exec.Cmd
+	exited  chan struct{}
+	// pid -> pid of firecracker, when reattached to a VM started by another process
+	pid int
+}
+
+// vmState is stored in the VM folder, to reattach to the VM from another process
+type vmState struct {
+	Tap string         `json:"tap"`
+	SSH sshutil.Target `json:"ssh"`
+}
+
+type bootSource struct {
+	KernelImagePath string `json:"kernel_image_path"`
+	BootArgs        string `json:"boot_args"`
+}
+
+type drive struct {
+	DriveID      string `json:"drive_id"`
+	PathOnHost   string `json:"path_on_host"`
+	IsRootDevice bool   `json:"is_root_device"`
+	IsReadOnly   bool   `json:"is_read_only"`
+}
+
+type machineConfig struct {
+	VcpuCount  int `json:"vcpu_count"`
+	MemSizeMib int `json:"mem_size_mib"`
+}
+
+type networkInterface struct {
+	IfaceID     string `json:"iface_id"`
+	GuestMac    string `json:"guest_mac"`
+	HostDevName string `json:"host_dev_name"`
+}
+
+type vmConfig struct {
+	BootSource        bootSource         `json:"boot-source"`
+	Drives            []drive            `json:"drives"`
+	MachineConfig     machineConfig      `json:"machine-config"`
+	NetworkInterfaces []networkInterface `json:"network-interfaces"`
+}
+
+func init() {
+	b := &firecrackerBackend{}
+	_ = vmbackends.RegisterBackend(b.String(), b)
+}
+
+func (b *firecrackerBackend) String() string {
+	return "firecracker"
+}
+
+func (b *firecrackerBackend) Desc() string {
+	return "Run Firecracker microVMs from kernel + rootfs pairs. Requires root privileges to set up tap devices."
+}
+
+func (b *firecrackerBackend) Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "firecracker.binary",
+			Usage: "firecracker executable used by the firecracker backend.",
+			Value: "firecracker",
+		},
+		cli.StringFlag{
+			Name: "firecracker.image-dir",
+			Usage: "Folder containing the images used by the firecracker backend. Image 'ubuntu/focal64' is looked up as " +
+				"the 'ubuntu_focal64' folder, containing 'vmlinux' and 'rootfs.ext4' files. " +
+				"Images in the '<kernel>+<rootfs>' form are used as file paths instead.",
+			Value: ".",
+		},
+		cli.StringFlag{
+			Name:  "firecracker.user",
+			Usage: "User to ssh into the VMs with.",
+			Value: "root",
+		},
+		cli.StringFlag{
+			Name:  "firecracker.ssh-key",
+			Usage: "Private key authorized for the user in every rootfs.",
+		},
+	}
+}
+
+func (b *firecrackerBackend) ParseCfg(c *cli.Context) error {
+	b.binary = c.GlobalString("firecracker.binary")
+	b.imageDir = c.GlobalString("firecracker.image-dir")
+	b.user = c.GlobalString("firecracker.user")
+	b.sshKey = c.GlobalString("firecracker.ssh-key")
+
+	if len(b.sshKey) == 0 {
+		return errors.New("empty 'firecracker.ssh-key' value")
+	}
+	if _, err := exec.LookPath(b.binary); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// imagePaths resolves the kernel and rootfs for the given box name
+func (b *firecrackerBackend) imagePaths(boxName string) (kernel, rootfs string, err error) {
+	if pair := strings.SplitN(boxName, "+", 2); len(pair) == 2 {
+		kernel, rootfs = pair[0], pair[1]
+	} else {
+		dir := filepath.Join(b.imageDir, strings.ReplaceAll(boxName, "/", "_"))
+		kernel, rootfs = filepath.Join(dir, kernelFile), filepath.Join(dir, rootfsFile)
+	}
+	for _, p := range []*string{&kernel, &rootfs} {
+		if _, err = os.Stat(*p); err != nil {
+			return
+		}
+		if *p, err = filepath.Abs(*p); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (b *firecrackerBackend) Create(ctx context.Context, conf *vmbackends.VMConfig, info chan<- string) (vmbackends.VM, error) {
+	kernel, rootfs, err := b.imagePaths(conf.BoxName)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Snapshot != nil {
+		rootfs = filepath.Join(conf.Snapshot.Dir, rootfsFile)
+	}
+	err = os.MkdirAll(conf.Path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// The rootfs is writable, so every VM needs its own copy
+	vmbackends.SendStr(info, "Copying rootfs '"+rootfs+"'")
+	err = run(ctx, "cp", "--reflink=auto", "--sparse=always", rootfs, filepath.Join(conf.Path, rootfsFile))
+	if err != nil {
+		return nil, err
+	}
+
+	tap, idx, err := createTap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vmbackends.SendStr(info, "Created tap device '"+tap+"'")
+	hostIP, guestIP := subnetIPs(idx)
+
+	vm := &firecrackerVM{
+		backend: b,
+		conf:    conf,
+		kernel:  kernel,
+		tap:     tap,
+		ssh: sshutil.Target{
+			User:    b.user,
+			Host:    guestIP,
+			Port:    22,
+			KeyFile: b.sshKey,
+		},
+	}
+	err = run(ctx, "ip", "addr", "add", hostIP+"/30", "dev", tap)
+	if err == nil {
+		err = run(ctx, "ip", "link", "set", tap, "up")
+	}
+	if err == nil {
+		err = vm.writeConfig(idx, hostIP, guestIP)
+	}
+	if err == nil {
+		err = vm.writeState()
+	}
+	if err != nil {
+		// Cleanup must happen even if ctx is what made creation fail
+		_ = run(context.Background(), "ip", "link", "del", tap)
+		return nil, err
+	}
+	return vm, nil
+}
+
+// Load reattaches to a VM, through the state stored in its folder
+func (b *firecrackerBackend) Load(ctx context.Context, conf *vmbackends.VMConfig) (vmbackends.VM, error) {
+	data, err := os.ReadFile(filepath.Join(conf.Path, stateFile))
+	if err != nil {
+		return nil, err
+	}
+	var state vmState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	vm := &firecrackerVM{backend: b, conf: conf, tap: state.Tap, ssh: state.SSH}
+	// The VM might have never been booted
+	if data, err := os.ReadFile(filepath.Join(conf.Path, pidFile)); err == nil {
+		vm.pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	return vm, nil
+}
+
+// DeleteSnapshot does nothing, firecracker snapshots are entirely in their folder
+func (b *firecrackerBackend) DeleteSnapshot(ctx context.Context, s *vmbackends.Snapshot, info chan<- string) error {
+	return nil
+}
+
+// Snapshot saves the rootfs, the kernel is always the one of the image
+func (v *firecrackerVM) Snapshot(ctx context.Context, s *vmbackends.Snapshot, info chan<- string) error {
+	tmp := filepath.Join(s.Dir, rootfsFile+".tmp")
+	err := run(ctx, "cp", "--reflink=auto", "--sparse=always", filepath.Join(v.conf.Path, rootfsFile), tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.Dir, rootfsFile))
+}
+
+func (v *firecrackerVM) ShellCmd() string {
+	return v.ssh.ShellCmd()
+}
+
+func (v *firecrackerVM) writeState() error {
+	data, err := json.Marshal(&vmState{Tap: v.tap, SSH: v.ssh})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(v.conf.Path, stateFile), data, 0644)
+}
+
+func (v *firecrackerVM) writeConfig(idx int, hostIP, guestIP string) error {
+	cfg := vmConfig{
+		BootSource: bootSource{
+			KernelImagePath: v.kernel,
+			BootArgs:        fmt.Sprintf(bootArgFmt, guestIP, hostIP),
+		},
+		Drives: []drive{{
+			DriveID:      "rootfs",
+			PathOnHost:   filepath.Join(v.conf.Path, rootfsFile),
+			IsRootDevice: true,
+		}},
+		MachineConfig: machineConfig{
+			VcpuCount:  v.conf.CPUs,
+			MemSizeMib: v.conf.Memory,
+		},
+		NetworkInterfaces: []networkInterface{{
+			IfaceID:     "eth0",
+			GuestMac:    fmt.Sprintf("06:00:ac:1e:%02x:%02x", (idx*4)>>8, (idx*4)&0xff),
+			HostDevName: v.tap,
+		}},
+	}
+	data, err := json.MarshalIndent(&cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(v.conf.Path, configFile), data, 0644)
+}
+
+func (v *firecrackerVM) Boot(ctx context.Context, info chan<- string) error {
+	console, err := os.Create(filepath.Join(v.conf.Path, consoleFile))
+	if err != nil {
+		return err
+	}
+	v.cmd = exec.Command(v.backend.binary, "--no-api", "--config-file", configFile)
+	v.cmd.Dir = v.conf.Path
+	v.cmd.Stdout = console
+	v.cmd.Stderr = console
+	err = v.cmd.Start()
+	if err != nil {
+		console.Close()
+		return err
+	}
+	v.exited = make(chan struct{})
+	_ = os.WriteFile(filepath.Join(v.conf.Path, pidFile), []byte(strconv.Itoa(v.cmd.Process.Pid)), 0644)
+	go func() {
+		_ = v.cmd.Wait()
+		console.Close()
+		close(v.exited)
+	}()
+
+	vmbackends.SendStr(info, "Waiting for ssh on "+v.ssh.Host)
+	err = v.ssh.WaitReady(ctx)
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-v.exited:
+		return fmt.Errorf("firecracker exited, see '%s': %v", filepath.Join(v.conf.Path, consoleFile), err)
+	default:
+		return err
+	}
+}
+
+func (v *firecrackerVM) Exec(ctx context.Context, cmd string, output chan<- string) error {
+	return v.ssh.Exec(ctx, cmd, output)
+}
+
+func (v *firecrackerVM) ExecStreams(ctx context.Context, cmd string, stdout, stderr chan<- string) error {
+	return v.ssh.ExecStreams(ctx, cmd, stdout, stderr)
+}
+
+func (v *firecrackerVM) Copy(ctx context.Context, src, dst string, info chan<- string) error {
+	return v.ssh.Copy(ctx, src, dst)
+}
+
+func (v *firecrackerVM) Download(ctx context.Context, src, dst string, info chan<- string) error {
+	return v.ssh.Download(ctx, src, dst)
+}
+
+// Halt reboots the guest, since firecracker exits as soon as its guest does so
+func (v *firecrackerVM) Halt(ctx context.Context, info chan<- string) error {
+	if v.exited == nil {
+		return nil
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, haltWaitTimeout)
+	defer cancel()
+	_ = v.ssh.Exec(waitCtx, "sudo reboot || reboot", info)
+	select {
+	case <-v.exited:
+		return nil
+	case <-waitCtx.Done():
+		vmbackends.SendStr(info, "VM did not stop in time, killing it")
+		return v.kill()
+	}
+}
+
+func (v *firecrackerVM) Destroy(ctx context.Context, info chan<- string) error {
+	err := v.kill()
+	if tapErr := run(ctx, "ip", "link", "del", v.tap); err == nil {
+		err = tapErr
+	}
+	if rmErr := os.RemoveAll(v.conf.Path); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+func (v *firecrackerVM) kill() error {
+	if v.exited == nil {
+		// Not a child of this process, if reattached
+		if v.pid > 0 && syscall.Kill(v.pid, 0) == nil {
+			return syscall.Kill(v.pid, syscall.SIGKILL)
+		}
+		return nil
+	}
+	select {
+	case <-v.exited:
+		return nil
+	default:
+	}
+	err := v.cmd.Process.Kill()
+	<-v.exited
+	return err
+}
+
+// createTap creates the first free tap device, returning its name and index
+func createTap(ctx context.Context) (string, int, error) {
+	for i := 0; i < maxTaps; i++ {
+		name := fmt.Sprintf("%s%d", tapPrefix, i)
+		if _, err := os.Stat("/sys/class/net/" + name); err == nil {
+			continue
+		}
+		err := run(ctx, "ip", "tuntap", "add", "dev", name, "mode", "tap")
+		if err == nil {
+			return name, i, nil
+		}
+		// Another process might have won the race on this name, just move on
+		if _, statErr := os.Stat("/sys/class/net/" + name); statErr != nil {
+			return "", 0, err
+		}
+	}
+	return "", 0, errors.New("no free tap device available")
+}
+
+// subnetIPs returns the host and guest addresses of the /30 subnet with the given index
+func subnetIPs(idx int) (string, string) {
+	base := idx * 4
+	return fmt.Sprintf("172.30.%d.%d", base>>8, (base&0xff)+1),
+		fmt.Sprintf("172.30.%d.%d", base>>8, (base&0xff)+2)
+}
+
+func run(ctx context.Context, name string, args ...string) error {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s: %s", name, err, out)
+	}
+	return nil
+}
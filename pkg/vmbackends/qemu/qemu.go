@@ -0,0 +1,439 @@
+package qemu
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends/sshutil"
+	"github.com/urfave/cli"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	diskFile    = "disk.qcow2"
+	seedFile    = "seed.iso"
+	keyFile     = "id_ed25519"
+	pidFile     = "qemu.pid"
+	monitorFile = "monitor.sock"
+	consoleFile = "console.log"
+	sshFile     = "ssh.json"
+	// Image of the snapshots, in their folder
+	snapshotFile = "image.qcow2"
+	// Name of the internal snapshot taken by Checkpoint
+	checkpointName = "vm-spinner"
+	monitorPrompt  = "(qemu) "
+
+	haltWaitTimeout = time.Minute
+
+	// Error of qemu failing to bind the ssh port, and times qemu is started on a new port because of it
+	hostfwdError    = "Could not set up host forwarding"
+	hostfwdAttempts = 3
+)
+
+const fmtUserData = `#cloud-config
+users:
+  - name: %s
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    shell: /bin/sh
+    ssh_authorized_keys:
+      - %s
+`
+
+const fmtMetaData = `instance-id: %s
+local-hostname: vm-spinner
+`
+
+type qemuBackend struct {
+	binary   string
+	accel    string
+	imageDir string
+	user     string
+}
+
+type qemuVM struct {
+	backend *qemuBackend
+	conf    *vmbackends.VMConfig
+	ssh     sshutil.Target
+}
+
+func init() {
+	b := &qemuBackend{}
+	_ = vmbackends.RegisterBackend(b.String(), b)
+}
+
+func (b *qemuBackend) String() string {
+	return "qemu"
+}
+
+func (b *qemuBackend) Desc() string {
+	return "Run VMs from qcow2 cloud images with qemu-system directly, without Vagrant."
+}
+
+func (b *qemuBackend) Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "qemu.binary",
+			Usage: "qemu-system executable used by the qemu backend.",
+			Value: "qemu-system-x86_64",
+		},
+		cli.StringFlag{
+			Name:  "qemu.accel",
+			Usage: "qemu accelerators, in order of preference.",
+			Value: "kvm:tcg",
+		},
+		cli.StringFlag{
+			Name: "qemu.image-dir",
+			Usage: "Folder containing the qcow2 cloud images used by the qemu backend. " +
+				"Image 'ubuntu/focal64' is looked up as 'ubuntu_focal64.qcow2' in it, unless it is a path to an existing file.",
+			Value: ".",
+		},
+		cli.StringFlag{
+			Name:  "qemu.user",
+			Usage: "User created with cloud-init in each VM by the qemu backend.",
+			Value: "vmspinner",
+		},
+	}
+}
+
+func (b *qemuBackend) ParseCfg(c *cli.Context) error {
+	b.binary = c.GlobalString("qemu.binary")
+	b.accel = c.GlobalString("qemu.accel")
+	b.imageDir = c.GlobalString("qemu.image-dir")
+	b.user = c.GlobalString("qemu.user")
+
+	if _, err := exec.LookPath(b.binary); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// imagePath resolves the cloud image for the given box name
+func (b *qemuBackend) imagePath(boxName string) (string, error) {
+	candidates := []string{boxName}
+	name := strings.ReplaceAll(boxName, "/", "_")
+	for _, ext := range []string{".qcow2", ".img"} {
+		candidates = append(candidates, filepath.Join(b.imageDir, name+ext))
+	}
+	for _, c := range candidates {
+		if s, err := os.Stat(c); err == nil && !s.IsDir() {
+			return filepath.Abs(c)
+		}
+	}
+	return "", fmt.Errorf("no qemu image found for '%s' in '%s'", boxName, b.imageDir)
+}
+
+func (b *qemuBackend) Create(ctx context.Context, conf *vmbackends.VMConfig, info chan<- string) (vmbackends.VM, error) {
+	image, err := b.imagePath(conf.BoxName)
+	if conf.Snapshot != nil {
+		image, err = filepath.Join(conf.Snapshot.Dir, snapshotFile), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(conf.Path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// Overlay disk, so that the base image is never written
+	vmbackends.SendStr(info, "Creating overlay disk on '"+image+"'")
+	err = run(ctx, conf.Path, "qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-b", image, diskFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// SSH key, and cloud-init seed authorizing it
+	vmbackends.SendStr(info, "Generating cloud-init seed")
+	err = run(ctx, conf.Path, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := os.ReadFile(filepath.Join(conf.Path, keyFile+".pub"))
+	if err != nil {
+		return nil, err
+	}
+	// The instance ID must be unique, for cloud-init to authorize the new key on VMs created from snapshots
+	err = writeSeed(ctx, conf.Path, fmt.Sprintf(fmtUserData, b.user, strings.TrimSpace(string(pubKey))),
+		fmt.Sprintf(fmtMetaData, fmt.Sprintf("vm-spinner-%d", time.Now().UnixNano())))
+	if err != nil {
+		return nil, err
+	}
+
+	// The ssh port is chosen by Boot
+	vm := &qemuVM{
+		backend: b,
+		conf:    conf,
+		ssh: sshutil.Target{
+			User:    b.user,
+			Host:    "127.0.0.1",
+			KeyFile: filepath.Join(conf.Path, keyFile),
+		},
+	}
+	err = vm.ssh.Save(filepath.Join(conf.Path, sshFile))
+	if err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// Load reattaches to a VM, through its pid file and ssh target stored in its folder
+func (b *qemuBackend) Load(ctx context.Context, conf *vmbackends.VMConfig) (vmbackends.VM, error) {
+	target, err := sshutil.Load(filepath.Join(conf.Path, sshFile))
+	if err != nil {
+		return nil, err
+	}
+	return &qemuVM{backend: b, conf: conf, ssh: *target}, nil
+}
+
+// DeleteSnapshot does nothing, qemu snapshots are entirely in their folder
+func (b *qemuBackend) DeleteSnapshot(ctx context.Context, s *vmbackends.Snapshot, info chan<- string) error {
+	return nil
+}
+
+// Snapshot flattens the overlay disk and its base image into a new standalone image
+func (v *qemuVM) Snapshot(ctx context.Context, s *vmbackends.Snapshot, info chan<- string) error {
+	// qemu might still be exiting, if forced to by Halt
+	if pid, err := v.pid(); err == nil {
+		for alive(pid) && ctx.Err() == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	tmp := filepath.Join(s.Dir, snapshotFile+".tmp")
+	err := run(ctx, v.conf.Path, "qemu-img", "convert", "-O", "qcow2", diskFile, tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.Dir, snapshotFile))
+}
+
+func (v *qemuVM) ShellCmd() string {
+	return v.ssh.ShellCmd()
+}
+
+// Boot starts qemu, forwarding ssh on an unused local port. The port is not reserved until qemu binds it,
+// thus another process might take it first (eg: a VM booted in parallel): qemu fails to start in that case,
+// and is only started again on a new port, as its user networking cannot be handed an already bound socket.
+func (v *qemuVM) Boot(ctx context.Context, info chan<- string) error {
+	var err error
+	for attempt := 1; attempt <= hostfwdAttempts; attempt++ {
+		err = v.start(ctx)
+		if err == nil || !strings.Contains(err.Error(), hostfwdError) {
+			break
+		}
+		vmbackends.SendStr(info, fmt.Sprintf("Port %d got taken before qemu started, retrying on another one", v.ssh.Port))
+	}
+	if err != nil {
+		return err
+	}
+
+	vmbackends.SendStr(info, "Waiting for ssh on port "+strconv.Itoa(v.ssh.Port))
+	return v.ssh.WaitReady(ctx)
+}
+
+// start starts qemu in the background, forwarding ssh on a port that is unused right before
+func (v *qemuVM) start(ctx context.Context) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	v.ssh.Port = l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	err = v.ssh.Save(filepath.Join(v.conf.Path, sshFile))
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"-name", filepath.Base(v.conf.Path),
+		"-machine", "accel=" + v.backend.accel,
+		"-cpu", "max",
+		"-smp", strconv.Itoa(v.conf.CPUs),
+		"-m", strconv.Itoa(v.conf.Memory),
+		"-drive", "file=" + diskFile + ",if=virtio,format=qcow2",
+		"-drive", "file=" + seedFile + ",if=virtio,format=raw,media=cdrom,readonly=on",
+		"-netdev", fmt.Sprintf("user,id=net0,hostfwd=tcp:127.0.0.1:%d-:22", v.ssh.Port),
+		"-device", "virtio-net-pci,netdev=net0",
+		"-display", "none",
+		"-serial", "file:" + consoleFile,
+		"-monitor", "unix:" + monitorFile + ",server,nowait",
+		"-pidfile", pidFile,
+		"-daemonize",
+	}
+	return run(ctx, v.conf.Path, v.backend.binary, args...)
+}
+
+func (v *qemuVM) Exec(ctx context.Context, cmd string, output chan<- string) error {
+	return v.ssh.Exec(ctx, cmd, output)
+}
+
+func (v *qemuVM) ExecStreams(ctx context.Context, cmd string, stdout, stderr chan<- string) error {
+	return v.ssh.ExecStreams(ctx, cmd, stdout, stderr)
+}
+
+func (v *qemuVM) Copy(ctx context.Context, src, dst string, info chan<- string) error {
+	return v.ssh.Copy(ctx, src, dst)
+}
+
+func (v *qemuVM) Download(ctx context.Context, src, dst string, info chan<- string) error {
+	return v.ssh.Download(ctx, src, dst)
+}
+
+// Halt asks for an ACPI shutdown, and forces it if the guest does not comply in time
+func (v *qemuVM) Halt(ctx context.Context, info chan<- string) error {
+	pid, err := v.pid()
+	if err != nil {
+		return err
+	}
+	err = v.monitor("system_powerdown")
+	if err != nil {
+		return err
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, haltWaitTimeout)
+	defer cancel()
+	for alive(pid) {
+		select {
+		case <-waitCtx.Done():
+			vmbackends.SendStr(info, "VM did not power off in time, stopping it")
+			return v.monitor("quit")
+		case <-time.After(time.Second):
+		}
+	}
+	return nil
+}
+
+// Checkpoint saves the whole VM state, memory included, as an internal snapshot of its disk
+func (v *qemuVM) Checkpoint(ctx context.Context, info chan<- string) error {
+	return v.monitorWait(ctx, "savevm "+checkpointName)
+}
+
+// Reset restores the VM state saved by Checkpoint, without rebooting it
+func (v *qemuVM) Reset(ctx context.Context, info chan<- string) error {
+	return v.monitorWait(ctx, "loadvm "+checkpointName)
+}
+
+func (v *qemuVM) Destroy(ctx context.Context, info chan<- string) error {
+	if pid, err := v.pid(); err == nil && alive(pid) {
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+	}
+	return os.RemoveAll(v.conf.Path)
+}
+
+func (v *qemuVM) pid() (int, error) {
+	data, err := os.ReadFile(filepath.Join(v.conf.Path, pidFile))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// monitor sends cmd to the qemu human monitor
+func (v *qemuVM) monitor(cmd string) error {
+	conn, err := net.Dial("unix", filepath.Join(v.conf.Path, monitorFile))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(cmd + "\n"))
+	return err
+}
+
+// monitorWait sends cmd to the qemu human monitor, and waits for it to complete
+func (v *qemuVM) monitorWait(ctx context.Context, cmd string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", filepath.Join(v.conf.Path, monitorFile))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	// The monitor greets with a prompt, and prints another one once cmd completes
+	r := bufio.NewReader(conn)
+	readPrompt := func() (string, error) {
+		var out strings.Builder
+		for !strings.HasSuffix(out.String(), monitorPrompt) {
+			b, err := r.ReadByte()
+			if err != nil {
+				return out.String(), err
+			}
+			out.WriteByte(b)
+		}
+		return out.String(), nil
+	}
+	_, err = readPrompt()
+	if err == nil {
+		_, err = conn.Write([]byte(cmd + "\n"))
+	}
+	var out string
+	if err == nil {
+		out, err = readPrompt()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	// Failures are only reported in the output
+	for _, l := range strings.Split(out, "\n") {
+		if strings.Contains(l, "Error") {
+			return fmt.Errorf("%s: %s", cmd, strings.TrimSpace(l))
+		}
+	}
+	return nil
+}
+
+func alive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+func run(ctx context.Context, dir, name string, args ...string) error {
+	c := exec.CommandContext(ctx, name, args...)
+	c.Dir = dir
+	out, err := c.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s: %s", name, err, out)
+	}
+	return nil
+}
+
+// writeSeed builds the NoCloud seed image read by cloud-init at first boot
+func writeSeed(ctx context.Context, dir, userData, metaData string) error {
+	err := os.WriteFile(filepath.Join(dir, "user-data"), []byte(userData), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "meta-data"), []byte(metaData), 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("cloud-localds"); err == nil {
+		return run(ctx, dir, "cloud-localds", seedFile, "user-data", "meta-data")
+	}
+	for _, tool := range []string{"genisoimage", "mkisofs"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			return run(ctx, dir, tool, "-output", seedFile, "-volid", "cidata", "-joliet", "-rock", "user-data", "meta-data")
+		}
+	}
+	return errors.New("one of cloud-localds, genisoimage or mkisofs is needed to build the cloud-init seed")
+}
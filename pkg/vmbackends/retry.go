@@ -0,0 +1,72 @@
+package vmbackends
+
+import (
+	"errors"
+	"regexp"
+	"time"
+)
+
+// DefaultRetryable lists the patterns of well known transient failures of VM creation and boot,
+// such as network hiccups during box downloads and VirtualBox lock errors. Timeouts are the ones
+// of the backend transports (eg: ssh), boots exceeding their own timeout are told apart by PhaseTimeoutError.
+var DefaultRetryable = []string{
+	`(?i)timed? ?out`,
+	`(?i)connection (reset|refused|closed)`,
+	`(?i)unexpectedly closed`,
+	`(?i)could not resolve host`,
+	`(?i)temporary failure in name resolution`,
+	`(?i)error occurred while downloading`,
+	`(?i)too ?many ?requests`,
+	`(?i)already locked`,
+	`VBOX_E_INVALID_OBJECT_STATE`,
+	`(?i)entered an invalid state`,
+}
+
+// RetryPolicy -> how failed VM creations and boots are retried.
+// Each retry starts over from a new VM, after destroying the one that failed.
+type RetryPolicy struct {
+	// MaxAttempts -> maximum number of attempts, values lower than 2 disable retries
+	MaxAttempts int
+	// Backoff -> wait before the first retry, doubled at each following one
+	Backoff time.Duration
+	// Retryable -> failures are retried only if their error, or the output of
+	// the failed attempt, matches one of these. Any failure is retried if empty.
+	Retryable []*regexp.Regexp
+	// RetryTimeouts -> whether attempts exceeding the timeout of their phase (see PhaseTimeoutError) are retried as well.
+	// They are not by default, as each of them takes the whole timeout, and hung boots are unlikely to be transient.
+	RetryTimeouts bool
+}
+
+// retryable returns whether another attempt is allowed after the given failed one
+func (p *RetryPolicy) retryable(attempt int, err error, output []string) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	var timeout *PhaseTimeoutError
+	if errors.As(err, &timeout) && !p.RetryTimeouts {
+		return false
+	}
+	if len(p.Retryable) == 0 {
+		return true
+	}
+	for _, r := range p.Retryable {
+		if r.MatchString(err.Error()) {
+			return true
+		}
+		for _, l := range output {
+			if r.MatchString(l) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before the retry following the given failed attempt
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < time.Hour; i++ {
+		d *= 2
+	}
+	return d
+}
@@ -0,0 +1,61 @@
+package vmbackends
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	phaseTimeout := fmt.Errorf("attempt failed: %w", &PhaseTimeoutError{Phase: "boot", Timeout: time.Minute, Err: errors.New("signal: killed")})
+	var defaults []*regexp.Regexp
+	for _, p := range DefaultRetryable {
+		defaults = append(defaults, regexp.MustCompile(p))
+	}
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		err     error
+		output  []string
+		want    bool
+	}{
+		{"any failure", RetryPolicy{MaxAttempts: 3}, 1, errors.New("boom"), nil, true},
+		{"attempts exhausted", RetryPolicy{MaxAttempts: 3}, 3, errors.New("boom"), nil, false},
+		{"retries disabled", RetryPolicy{MaxAttempts: 1}, 1, errors.New("boom"), nil, false},
+		{"matching error", RetryPolicy{MaxAttempts: 3, Retryable: defaults}, 1, errors.New("ssh: connection reset by peer"), nil, true},
+		{"matching output", RetryPolicy{MaxAttempts: 3, Retryable: defaults}, 2, errors.New("exit status 1"),
+			[]string{"Downloading box", "An error occurred while downloading the remote file"}, true},
+		{"not matching", RetryPolicy{MaxAttempts: 3, Retryable: defaults}, 1, errors.New("box not found"), []string{"Bringing machine up"}, false},
+		{"transport timeout", RetryPolicy{MaxAttempts: 3, Retryable: defaults}, 1, errors.New("ssh: connect to host: Connection timed out"), nil, true},
+		{"phase timeout", RetryPolicy{MaxAttempts: 3, Retryable: defaults}, 1, phaseTimeout, nil, false},
+		{"phase timeout of any failure", RetryPolicy{MaxAttempts: 3}, 1, phaseTimeout, nil, false},
+		{"phase timeout retried", RetryPolicy{MaxAttempts: 3, Retryable: defaults, RetryTimeouts: true}, 1, phaseTimeout, nil, true},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.retryable(tt.attempt, tt.err, tt.output); got != tt.want {
+			t.Errorf("%s: retryable = %v, expected %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 30 * time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, 64 * time.Minute},
+		{100, 64 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := p.backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %v, expected %v", tt.attempt, got, tt.want)
+		}
+	}
+}
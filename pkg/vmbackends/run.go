@@ -0,0 +1,550 @@
+package vmbackends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Lines buffered in each of the channels of VMChannels. Once full, the VM is slowed down
+// until they are received (eg: commands block writing their output), thus no line is lost.
+const channelBufferSize = 256
+
+// Lines of each output stream kept in the result of each VM. Older lines are left out, as the whole
+// output of chatty jobs (eg: builds) would be held in memory for each VM, while it is delivered anyway.
+const resultOutputLines = 1000
+
+// PhaseTimeoutError -> error of a phase of the VM lifecycle that exceeded its timeout
+type PhaseTimeoutError struct {
+	Phase   vmjobs.VMPhase
+	Timeout time.Duration
+	// Err -> error of the phase, once interrupted
+	Err error
+}
+
+func (e *PhaseTimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v: %s", e.Phase, e.Timeout, e.Err)
+}
+
+func (e *PhaseTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// VMChannels -> progress of a VM, to be received until all the channels but Done are closed.
+// Lines are delivered in the order they were sent, except for Debug ones, which are
+// dropped when Debug is full and counted in the DroppedDebugLines of the result.
+type VMChannels struct {
+	// CmdOutput -> lines printed by the job commands, along with their stream
+	CmdOutput <-chan vmjobs.OutputLine
+	Debug     <-chan string
+	Info      <-chan string
+	Error     <-chan error
+	// Done -> receives the result once the VM is gone, after all the other channels are closed
+	Done <-chan *vmjobs.VMResult
+}
+
+// SendStr sends v to c, waiting for c to be ready to receive it. Nothing is sent to nil channels.
+// Backends should use it for all the lines they report.
+func SendStr(c chan<- string, v string) {
+	if c != nil {
+		c <- v
+	}
+}
+
+// RunVirtualMachine creates, boots and runs the job of conf on a VM of the given backend,
+// then halts and destroys it. The whole lifecycle is run asynchronously, and its
+// progress is reported through the returned channels.
+// Once ctx is cancelled, the running phase is interrupted and the VM is torn down.
+func RunVirtualMachine(ctx context.Context, backend VMBackend, conf *VMConfig) *VMChannels {
+	output := make(chan vmjobs.OutputLine, channelBufferSize)
+	debug := make(chan string, channelBufferSize)
+	info := make(chan string, channelBufferSize)
+	err := make(chan error, 1)
+	done := make(chan *vmjobs.VMResult, 1)
+
+	go func() {
+		res := runVirtualMachine(ctx, backend, conf, output, debug, info)
+		if res.Err != nil {
+			err <- res.Err
+		}
+		if len(res.KeptPath) == 0 {
+			os.RemoveAll(conf.Path)
+		}
+		close(output)
+		close(debug)
+		close(info)
+		close(err)
+		done <- res
+		close(done)
+	}()
+
+	return &VMChannels{
+		CmdOutput: output,
+		Debug:     debug,
+		Info:      info,
+		Error:     err,
+		Done:      done,
+	}
+}
+
+// captureOutput relays lines to output, appending them to lines as well.
+// The returned channel must be closed to wait for all lines to be captured.
+func captureOutput(output chan<- string, lines *[]string) (chan<- string, func()) {
+	captured := make(chan string, 64)
+	done := make(chan struct{})
+	go func() {
+		for l := range captured {
+			*lines = append(*lines, l)
+			SendStr(output, l)
+		}
+		close(done)
+	}()
+	return captured, func() {
+		close(captured)
+		<-done
+	}
+}
+
+// tail keeps the last resultOutputLines lines added to it, in at most twice as much memory
+type tail struct {
+	lines   []string
+	dropped int
+}
+
+func (t *tail) add(l string) {
+	if len(t.lines) == 2*resultOutputLines {
+		n := copy(t.lines, t.lines[resultOutputLines:])
+		t.lines = t.lines[:n]
+		t.dropped += resultOutputLines
+	}
+	t.lines = append(t.lines, l)
+}
+
+// get returns the lines kept, and the number of the older ones left out
+func (t *tail) get() ([]string, int) {
+	if extra := len(t.lines) - resultOutputLines; extra > 0 {
+		return t.lines[extra:], t.dropped + extra
+	}
+	return t.lines, t.dropped
+}
+
+// captureStreams relays the lines sent to the returned stdout and stderr channels to output, along with
+// their stream and the time they were received, keeping the last ones in the Stdout and Stderr of res as well.
+// The returned function must be called to wait for all lines to be captured.
+func captureStreams(output chan<- vmjobs.OutputLine, res *vmjobs.VMResult) (chan<- string, chan<- string, func()) {
+	stdout := make(chan string, 64)
+	stderr := make(chan string, 64)
+	done := make(chan struct{})
+	go func() {
+		var (
+			outTail, errTail   tail
+			outLines, errLines <-chan string = stdout, stderr
+		)
+		for outLines != nil || errLines != nil {
+			select {
+			case l, ok := <-outLines:
+				if !ok {
+					outLines = nil
+					continue
+				}
+				outTail.add(l)
+				output <- vmjobs.OutputLine{Stream: vmjobs.StreamStdout, Time: time.Now(), Text: l}
+			case l, ok := <-errLines:
+				if !ok {
+					errLines = nil
+					continue
+				}
+				errTail.add(l)
+				output <- vmjobs.OutputLine{Stream: vmjobs.StreamStderr, Time: time.Now(), Text: l}
+			}
+		}
+		res.Stdout, res.DroppedStdoutLines = outTail.get()
+		res.Stderr, res.DroppedStderrLines = errTail.get()
+		close(done)
+	}()
+	return stdout, stderr, func() {
+		close(stdout)
+		close(stderr)
+		<-done
+	}
+}
+
+// artifact -> a path in a VM matching one of the artifacts of a job
+type artifact struct {
+	// remote -> absolute path in the VM
+	remote string
+	// local -> path relative to the artifacts folder, mirroring the remote one
+	local string
+}
+
+// expandArtifacts returns the paths in vm matching pattern, a shell glob.
+// Relative paths are mirrored as they are in the artifacts folder, absolute ones and the ones out of the working directory of
+// the commands are mirrored from the VM root.
+func expandArtifacts(ctx context.Context, vm VM, pattern string, info chan<- string) ([]artifact, error) {
+	var lines []string
+	stdout, stopCapture := captureOutput(nil, &lines)
+	// The first line is the working directory, the following ones the existing paths matching pattern
+	err := ExecStreams(ctx, vm, `pwd; for f in `+pattern+`; do if [ -e "$f" ] || [ -L "$f" ]; then echo "$f"; fi; done`, stdout, info)
+	stopCapture()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("working directory not found")
+	}
+
+	var artifacts []artifact
+	wd := lines[0]
+	for _, p := range lines[1:] {
+		a := artifact{remote: p, local: path.Clean(p)}
+		if !path.IsAbs(p) {
+			a.remote = path.Join(wd, p)
+		}
+		if path.IsAbs(a.local) || a.local == ".." || strings.HasPrefix(a.local, "../") {
+			a.local = strings.TrimPrefix(a.remote, "/")
+		}
+		artifacts = append(artifacts, a)
+	}
+	return artifacts, nil
+}
+
+// exitCode returns the exit code of the command that returned err, or -1 if it is unknown
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+func runVirtualMachine(ctx context.Context, backend VMBackend, conf *VMConfig, output chan<- vmjobs.OutputLine, debug, info chan<- string) *vmjobs.VMResult {
+	var vm VM
+
+	res := &vmjobs.VMResult{
+		VM:       conf.BoxName,
+		Status:   vmjobs.VMStatusSucceeded,
+		ExitCode: -1,
+		Start:    time.Now(),
+		Timings:  make(map[vmjobs.VMPhase]time.Duration),
+	}
+	defer func() {
+		res.End = time.Now()
+	}()
+
+	// sendDebug sends v to debug, unless it is full, as debug lines are the least important ones
+	sendDebug := func(v string) {
+		select {
+		case debug <- v:
+		default:
+			res.DroppedDebugLines++
+		}
+	}
+
+	// attemptPhase runs f, accounting its duration to phase, and bounding it with timeout if not zero
+	attemptPhase := func(parent context.Context, phase vmjobs.VMPhase, timeout time.Duration, f func(context.Context) error) error {
+		phaseCtx, cancel := context.WithCancel(parent)
+		if timeout > 0 {
+			phaseCtx, cancel = context.WithTimeout(parent, timeout)
+		}
+		defer cancel()
+
+		start := time.Now()
+		err := f(phaseCtx)
+		res.Timings[phase] += time.Since(start)
+		if err != nil && parent.Err() == nil && errors.Is(phaseCtx.Err(), context.DeadlineExceeded) {
+			err = &PhaseTimeoutError{Phase: phase, Timeout: timeout, Err: err}
+		}
+		return err
+	}
+
+	// fail records the failure of phase. Only the first failure is recorded,
+	// as the following ones are likely consequences of it.
+	fail := func(parent context.Context, phase vmjobs.VMPhase, err error) {
+		if res.Failed() {
+			return
+		}
+		res.FailedPhase = phase
+		res.Status = vmjobs.VMStatusFailed
+		res.Err = err
+		if parent.Err() != nil {
+			res.Status = vmjobs.VMStatusCancelled
+			res.Err = parent.Err()
+		}
+	}
+
+	// runPhase is the same as attemptPhase, but records its failure
+	runPhase := func(parent context.Context, phase vmjobs.VMPhase, timeout time.Duration, f func(context.Context) error) error {
+		err := attemptPhase(parent, phase, timeout, f)
+		if err != nil {
+			fail(parent, phase, err)
+		}
+		return err
+	}
+
+	// cancelled records the cancellation of the run before phase, if any
+	cancelled := func(phase vmjobs.VMPhase) bool {
+		if ctx.Err() == nil {
+			return false
+		}
+		if !res.Failed() {
+			res.Status = vmjobs.VMStatusCancelled
+			res.FailedPhase = phase
+			res.Err = ctx.Err()
+		}
+		return true
+	}
+
+	// Teardown phases do not depend on ctx, so that VMs get destroyed even if the run is cancelled.
+	// attemptDestroy destroys vm, without recording its failure.
+	attemptDestroy := func(vm VM) error {
+		sendDebug("Destroying " + backend.String() + " VM for '" + conf.BoxName + "'")
+		return attemptPhase(context.Background(), vmjobs.VMPhaseDestroy, conf.TeardownTimeout, func(ctx context.Context) error {
+			return vm.Destroy(ctx, info)
+		})
+	}
+
+	// destroy is the same as attemptDestroy, but records its failure
+	destroy := func(vm VM) error {
+		err := attemptDestroy(vm)
+		if err != nil {
+			fail(context.Background(), vmjobs.VMPhaseDestroy, err)
+		}
+		return err
+	}
+
+	// teardown halts vm, if it booted, and destroys it, unless it must be kept alive
+	teardown := func(vm VM, booted bool) {
+		if conf.Keep == KeepAlways || (conf.Keep == KeepOnFailure && res.Status == vmjobs.VMStatusFailed) {
+			res.KeptPath = conf.Path
+			if s, ok := vm.(VMShellCommander); ok {
+				res.ShellCmd = s.ShellCmd()
+			}
+			SendStr(info, "Keeping "+backend.String()+" VM for '"+conf.BoxName+"' in '"+conf.Path+"'")
+			return
+		}
+		if booted {
+			sendDebug("Halting " + backend.String() + " VM for '" + conf.BoxName + "'")
+			_ = runPhase(context.Background(), vmjobs.VMPhaseHalt, conf.TeardownTimeout, func(ctx context.Context) error {
+				return vm.Halt(ctx, info)
+			})
+		}
+		_ = destroy(vm)
+	}
+
+	// collect downloads the artifacts of the job out of vm. Artifacts of failed jobs are the most useful ones,
+	// thus they are only skipped if the run is cancelled.
+	collect := func(vm VM) {
+		j, ok := conf.Job.(vmjobs.VMJobCollector)
+		if !ok || len(conf.ArtifactsDir) == 0 || ctx.Err() != nil {
+			return
+		}
+		patterns := j.Artifacts()
+		if len(patterns) == 0 {
+			return
+		}
+		downloader, ok := vm.(VMDownloader)
+		if !ok {
+			SendStr(info, "Skipping artifacts, as "+backend.String()+" VMs can't download files")
+			return
+		}
+		sendDebug("Downloading artifacts from VM for '" + conf.BoxName + "'")
+		_ = runPhase(ctx, vmjobs.VMPhaseDownload, conf.JobTimeout, func(ctx context.Context) error {
+			for _, pattern := range patterns {
+				artifacts, err := expandArtifacts(ctx, vm, pattern, info)
+				if err != nil {
+					return fmt.Errorf("can't expand '%s': %w", pattern, err)
+				}
+				if len(artifacts) == 0 {
+					SendStr(info, "No artifact matches '"+pattern+"'")
+				}
+				for _, a := range artifacts {
+					dst := filepath.Join(conf.ArtifactsDir, a.local)
+					// eg: matched by several patterns, or contained in a directory downloaded already
+					if _, err := os.Lstat(dst); err == nil {
+						continue
+					}
+					err = os.MkdirAll(filepath.Dir(dst), 0755)
+					if err != nil {
+						return err
+					}
+					SendStr(info, "Downloading '"+a.remote+"' to '"+dst+"'")
+					err = downloader.Download(ctx, a.remote, dst, info)
+					if err != nil {
+						return fmt.Errorf("can't download '%s': %w", a.remote, err)
+					}
+					if _, err := os.Lstat(dst); err == nil {
+						res.ArtifactsDir = conf.ArtifactsDir
+					}
+				}
+			}
+			return nil
+		})
+	}
+
+	// Look for a snapshot of the provisioned VM to create it from. If there is none, it is
+	// saved after provisioning the VM, and held locked so that other VMs wait to reuse it.
+	var provision []string
+	if p, ok := conf.Job.(vmjobs.VMJobProvisioner); ok {
+		provision = p.Provision()
+	}
+	createConf, unlockSnapshot := conf, func() {}
+	var snapshot *Snapshot
+	if _, ok := backend.(VMBackendSnapshotter); ok && len(conf.SnapshotDir) > 0 && len(provision) > 0 {
+		snapshot = newSnapshot(backend, conf, provision)
+		sendDebug("Waiting for snapshot '" + snapshot.Name + "' of '" + conf.BoxName + "'")
+		err := runPhase(ctx, vmjobs.VMPhaseCreate, 0, func(ctx context.Context) (err error) {
+			unlockSnapshot, err = snapshot.lock(ctx)
+			return
+		})
+		if err != nil {
+			return res
+		}
+		defer unlockSnapshot()
+		if snapshot.exists() {
+			SendStr(info, "Creating VM from snapshot '"+snapshot.Name+"'")
+			unlockSnapshot()
+			c := *conf
+			c.Snapshot = snapshot
+			createConf = &c
+			provision, snapshot = nil, nil
+		}
+	}
+
+	// Create and start up the VM, starting over from a new one on retryable failures
+	for res.BootAttempts = 1; ; res.BootAttempts++ {
+		if cancelled(vmjobs.VMPhaseCreate) {
+			return res
+		}
+		var attemptOutput []string
+		attemptInfo, stopCapture := captureOutput(info, &attemptOutput)
+		phase, err := vmjobs.VMPhaseCreate, error(nil)
+		sendDebug("Creating " + backend.String() + " VM for '" + conf.BoxName + "' on '" + conf.ProviderName + "' provider")
+		err = attemptPhase(ctx, phase, 0, func(ctx context.Context) (err error) {
+			vm, err = backend.Create(ctx, createConf, attemptInfo)
+			return
+		})
+		if err == nil {
+			phase = vmjobs.VMPhaseBoot
+			sendDebug("Starting " + backend.String() + " VM for '" + conf.BoxName + "'")
+			err = attemptPhase(ctx, phase, conf.BootTimeout, func(ctx context.Context) error {
+				return vm.Boot(ctx, attemptInfo)
+			})
+		}
+		stopCapture()
+		if err == nil {
+			break
+		}
+
+		if ctx.Err() != nil || !conf.BootRetry.retryable(res.BootAttempts, err, attemptOutput) {
+			fail(ctx, phase, err)
+			if vm != nil {
+				teardown(vm, false)
+			}
+			return res
+		}
+		backoff := conf.BootRetry.backoff(res.BootAttempts)
+		SendStr(info, fmt.Sprintf("Attempt %d to %s VM for '%s' failed, retrying in %v: %s", res.BootAttempts, phase, conf.BoxName, backoff, err))
+		if vm != nil {
+			// The VM of the next attempt might need the same resources (eg: its path), so wait for it to be gone.
+			// Destroy failures are likely to make the next attempts fail as well, thus the VM fails with the
+			// error of this attempt, as that is what caused it.
+			if destroyErr := attemptDestroy(vm); destroyErr != nil {
+				SendStr(info, "Not retrying, as the VM of the failed attempt could not be destroyed: "+destroyErr.Error())
+				fail(ctx, phase, err)
+				return res
+			}
+			vm = nil
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+	}
+	defer teardown(vm, true)
+	// Deferred calls run in reverse order, thus artifacts are downloaded before the teardown
+	defer collect(vm)
+
+	// Provision the VM, then save it as a snapshot if needed
+	if len(provision) > 0 {
+		if cancelled(vmjobs.VMPhaseProvision) {
+			return res
+		}
+		sendDebug("Provisioning VM for '" + conf.BoxName + "'")
+		err := runPhase(ctx, vmjobs.VMPhaseProvision, conf.JobTimeout, func(ctx context.Context) error {
+			for _, cmd := range provision {
+				err := vm.Exec(ctx, cmd, info)
+				if err != nil {
+					return err
+				}
+			}
+			if snapshot == nil {
+				return nil
+			}
+			return saveSnapshot(ctx, vm, snapshot, info)
+		})
+		unlockSnapshot()
+		if err != nil {
+			return res
+		}
+	}
+
+	// Copy the files of the job into the VM
+	var uploads []vmjobs.Upload
+	if j, ok := conf.Job.(vmjobs.VMJobUploader); ok {
+		uploads = j.Uploads()
+	}
+	if len(uploads) > 0 {
+		if cancelled(vmjobs.VMPhaseUpload) {
+			return res
+		}
+		sendDebug("Uploading files to VM for '" + conf.BoxName + "'")
+		err := runPhase(ctx, vmjobs.VMPhaseUpload, conf.JobTimeout, func(ctx context.Context) error {
+			for _, u := range uploads {
+				SendStr(info, "Uploading '"+u.Src+"' to '"+u.Dst+"'")
+				err := vm.Copy(ctx, u.Src, u.Dst, info)
+				if err != nil {
+					return fmt.Errorf("can't upload '%s': %w", u.Src, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return res
+		}
+	}
+
+	// Run the job commands
+	sendDebug("Running command for '" + conf.BoxName + "'")
+	stdout, stderr, stopCapture := captureStreams(output, res)
+	exitHandler, isExitHandler := conf.Job.(vmjobs.VMJobExitHandler)
+	_ = runPhase(ctx, vmjobs.VMPhaseJob, conf.JobTimeout, func(jobCtx context.Context) error {
+		for {
+			if cancelled(vmjobs.VMPhaseJob) {
+				return nil
+			}
+			cmd, hasMore := conf.Job.Cmd()
+			err := ExecStreams(jobCtx, vm, cmd, stdout, stderr)
+			res.ExitCode = exitCode(err)
+			res.ExitCodes = append(res.ExitCodes, res.ExitCode)
+			goOn := hasMore && err == nil
+			if isExitHandler && res.ExitCode >= 0 {
+				goOn = exitHandler.CmdExited(conf.BoxName, res.ExitCode) && hasMore
+			}
+			if !goOn {
+				return err
+			}
+		}
+	})
+	stopCapture()
+	return res
+}
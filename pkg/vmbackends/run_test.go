@@ -0,0 +1,118 @@
+package vmbackends
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs"
+)
+
+func TestTail(t *testing.T) {
+	tests := []struct {
+		added       int
+		wantFirst   int
+		wantDropped int
+	}{
+		{0, 0, 0},
+		{10, 0, 0},
+		{resultOutputLines, 0, 0},
+		{resultOutputLines + 1, 1, 1},
+		{2*resultOutputLines + 1, resultOutputLines + 1, resultOutputLines + 1},
+		{5*resultOutputLines + 7, 4*resultOutputLines + 7, 4*resultOutputLines + 7},
+	}
+	for _, tt := range tests {
+		var tl tail
+		for i := 0; i < tt.added; i++ {
+			tl.add(strconv.Itoa(i))
+		}
+		if len(tl.lines) > 2*resultOutputLines {
+			t.Errorf("%d lines added: %d lines held", tt.added, len(tl.lines))
+		}
+		lines, dropped := tl.get()
+		if dropped != tt.wantDropped {
+			t.Errorf("%d lines added: %d dropped, expected %d", tt.added, dropped, tt.wantDropped)
+		}
+		if len(lines) != tt.added-tt.wantDropped {
+			t.Fatalf("%d lines added: %d kept, expected %d", tt.added, len(lines), tt.added-tt.wantDropped)
+		}
+		for i, l := range lines {
+			if l != strconv.Itoa(tt.wantFirst+i) {
+				t.Fatalf("%d lines added: line %d is '%s', expected '%d'", tt.added, i, l, tt.wantFirst+i)
+			}
+		}
+	}
+}
+
+// brokenBackend creates VMs that never boot, nor get destroyed
+type brokenBackend struct{}
+
+type brokenVM struct{}
+
+func (b *brokenBackend) String() string {
+	return "broken"
+}
+
+func (b *brokenBackend) Desc() string {
+	return "VMs that never boot"
+}
+
+func (b *brokenBackend) Create(ctx context.Context, conf *VMConfig, info chan<- string) (VM, error) {
+	return &brokenVM{}, nil
+}
+
+func (v *brokenVM) Boot(ctx context.Context, info chan<- string) error {
+	return errors.New("connection reset by peer")
+}
+
+func (v *brokenVM) Exec(ctx context.Context, cmd string, output chan<- string) error {
+	return nil
+}
+
+func (v *brokenVM) Copy(ctx context.Context, src, dst string, info chan<- string) error {
+	return nil
+}
+
+func (v *brokenVM) Halt(ctx context.Context, info chan<- string) error {
+	return nil
+}
+
+func (v *brokenVM) Destroy(ctx context.Context, info chan<- string) error {
+	return errors.New("VM is locked")
+}
+
+func TestRunVirtualMachineRetryDestroyFailure(t *testing.T) {
+	conf := &VMConfig{Path: t.TempDir(), BoxName: "box", BootRetry: RetryPolicy{MaxAttempts: 3}}
+	channels := RunVirtualMachine(context.Background(), &brokenBackend{}, conf)
+	output, debug, info, errs := channels.CmdOutput, channels.Debug, channels.Info, channels.Error
+	for output != nil || debug != nil || info != nil || errs != nil {
+		select {
+		case _, ok := <-output:
+			if !ok {
+				output = nil
+			}
+		case _, ok := <-debug:
+			if !ok {
+				debug = nil
+			}
+		case _, ok := <-info:
+			if !ok {
+				info = nil
+			}
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+		}
+	}
+	res := <-channels.Done
+
+	// The boot failure caused the VM to fail, not the destroy one
+	if res.FailedPhase != vmjobs.VMPhaseBoot || res.Err == nil || res.Err.Error() != "connection reset by peer" {
+		t.Errorf("VM failed in %s phase with '%v', expected boot phase with the boot error", res.FailedPhase, res.Err)
+	}
+	if res.BootAttempts != 1 {
+		t.Errorf("%d boot attempts, expected 1", res.BootAttempts)
+	}
+}
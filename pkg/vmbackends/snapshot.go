@@ -0,0 +1,189 @@
+package vmbackends
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Files of each snapshot folder, besides the ones stored by backends
+const (
+	snapshotInfoFile = "snapshot.json"
+	snapshotLockFile = ".lock"
+)
+
+var invalidSnapshotChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// Snapshot -> a provisioned VM, saved to create new VMs from in place of provisioning them again.
+// Each snapshot has its own folder, where backends can store their files.
+type Snapshot struct {
+	// Name -> unique name of the snapshot, depending on the image and on how it was provisioned.
+	// It only contains lowercase letters, digits, '_', '.' and '-'.
+	Name         string    `json:"name"`
+	Dir          string    `json:"-"`
+	Backend      string    `json:"backend"`
+	BoxName      string    `json:"boxName"`
+	ProviderName string    `json:"providerName"`
+	Created      time.Time `json:"created"`
+}
+
+// VMBackendSnapshotter -> implements this interface to let VMs be created from snapshots of provisioned VMs, reused across runs.
+// Create must create VMs from the Snapshot field of VMConfig when set, and VMs must implement VMSnapshotter.
+type VMBackendSnapshotter interface {
+	// DeleteSnapshot -> deletes what the backend stored for s out of its folder, if anything (eg: a Vagrant box)
+	DeleteSnapshot(ctx context.Context, s *Snapshot, info chan<- string) error
+}
+
+// VMSnapshotter -> implemented by the VMs of backends implementing VMBackendSnapshotter
+type VMSnapshotter interface {
+	// Snapshot -> saves the halted VM as s
+	Snapshot(ctx context.Context, s *Snapshot, info chan<- string) error
+}
+
+// newSnapshot returns the snapshot of the VM described by conf, once provisioned with the given commands
+func newSnapshot(backend VMBackend, conf *VMConfig, provision []string) *Snapshot {
+	h := sha256.New()
+	for _, s := range append([]string{backend.String(), conf.ProviderName, conf.BoxName}, provision...) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	name := invalidSnapshotChars.ReplaceAllString(strings.ToLower(conf.BoxName), "_") + "-" + hex.EncodeToString(h.Sum(nil))[:12]
+	return &Snapshot{
+		Name:         name,
+		Dir:          filepath.Join(conf.SnapshotDir, backend.String(), name),
+		Backend:      backend.String(),
+		BoxName:      conf.BoxName,
+		ProviderName: conf.ProviderName,
+	}
+}
+
+// exists returns whether the snapshot was completely saved
+func (s *Snapshot) exists() bool {
+	_, err := os.Stat(filepath.Join(s.Dir, snapshotInfoFile))
+	return err == nil
+}
+
+// save marks the snapshot as completely saved
+func (s *Snapshot) save() error {
+	s.Created = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.Dir, snapshotInfoFile), data, 0644)
+}
+
+// lock waits for the exclusive use of the snapshot folder, so that concurrent VMs of
+// the same image, even from different runs, do not provision and save it twice
+func (s *Snapshot) lock(ctx context.Context) (unlock func(), err error) {
+	err = os.MkdirAll(s.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(s.Dir, snapshotLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			// Safe to be called more than once
+			return func() {
+				if f != nil {
+					f.Close()
+					f = nil
+				}
+			}, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// saveSnapshot halts vm to save it as s, then boots it again
+func saveSnapshot(ctx context.Context, vm VM, s *Snapshot, info chan<- string) error {
+	snapshotter, ok := vm.(VMSnapshotter)
+	if !ok {
+		return fmt.Errorf("VM does not support snapshots")
+	}
+	err := vm.Halt(ctx, info)
+	if err != nil {
+		return err
+	}
+	SendStr(info, "Saving snapshot '"+s.Name+"'")
+	err = snapshotter.Snapshot(ctx, s, info)
+	if err == nil {
+		err = s.save()
+	}
+	if err != nil {
+		return err
+	}
+	return vm.Boot(ctx, info)
+}
+
+// ListSnapshots returns the snapshots saved in dir, oldest first
+func ListSnapshots(dir string) ([]*Snapshot, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*", snapshotInfoFile))
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*Snapshot, 0, len(files))
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		s := &Snapshot{Dir: filepath.Dir(f)}
+		err = json.Unmarshal(data, s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", f, err)
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+	return snapshots, nil
+}
+
+// DeleteSnapshot deletes s, along with what its backend stored for it
+func DeleteSnapshot(ctx context.Context, s *Snapshot, info chan<- string) error {
+	backend, err := GetBackend(s.Backend)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Mark it as incomplete first, so that it is never used half deleted
+	err = os.Remove(filepath.Join(s.Dir, snapshotInfoFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if b, ok := backend.(VMBackendSnapshotter); ok {
+		err = b.DeleteSnapshot(ctx, s, info)
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(s.Dir)
+}
@@ -0,0 +1,118 @@
+package sshutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Target describes how to reach a VM through the system ssh client.
+// It is shared by the backends that do not provide their own way to run commands.
+type Target struct {
+	User    string `json:"user"`
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	KeyFile string `json:"keyFile"`
+}
+
+// VMs are ephemeral, thus there is no point in checking their host keys
+var sshOptions = []string{
+	"-o", "StrictHostKeyChecking=no",
+	"-o", "UserKnownHostsFile=/dev/null",
+	"-o", "LogLevel=ERROR",
+	"-o", "BatchMode=yes",
+	"-o", "ConnectTimeout=5",
+}
+
+func (t *Target) address() string {
+	return t.User + "@" + t.Host
+}
+
+func (t *Target) sshArgs(cmd string) []string {
+	args := append([]string{}, sshOptions...)
+	args = append(args, "-i", t.KeyFile, "-p", strconv.Itoa(t.Port), t.address(), cmd)
+	return args
+}
+
+// ShellCmd returns the command line opening an interactive shell on the target
+func (t *Target) ShellCmd() string {
+	args := append([]string{"ssh"}, sshOptions...)
+	args = append(args, "-i", vmbackends.ShellQuote(t.KeyFile), "-p", strconv.Itoa(t.Port), t.address())
+	return strings.Join(args, " ")
+}
+
+// Save stores the target in path, to reach it again from another process
+func (t *Target) Save(path string) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Load reads a target stored in path by Save
+func Load(path string) (*Target, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &Target{}
+	err = json.Unmarshal(data, t)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return t, nil
+}
+
+// Exec runs cmd on the target, sending each line of its output to output
+func (t *Target) Exec(ctx context.Context, cmd string, output chan<- string) error {
+	return vmbackends.RunCmd(exec.CommandContext(ctx, "ssh", t.sshArgs(cmd)...), output)
+}
+
+// ExecStreams runs cmd on the target, sending each line of its stdout and stderr to the respective channel
+func (t *Target) ExecStreams(ctx context.Context, cmd string, stdout, stderr chan<- string) error {
+	return vmbackends.RunCmdStreams(exec.CommandContext(ctx, "ssh", t.sshArgs(cmd)...), stdout, stderr)
+}
+
+// Copy recursively copies the local src to dst on the target
+func (t *Target) Copy(ctx context.Context, src, dst string) error {
+	args := append([]string{}, sshOptions...)
+	args = append(args, "-r", "-i", t.KeyFile, "-P", strconv.Itoa(t.Port), src, t.address()+":"+dst)
+	out, err := exec.CommandContext(ctx, "scp", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	return nil
+}
+
+// Download recursively copies src on the target to the local dst
+func (t *Target) Download(ctx context.Context, src, dst string) error {
+	args := append([]string{}, sshOptions...)
+	args = append(args, "-r", "-i", t.KeyFile, "-P", strconv.Itoa(t.Port), t.address()+":"+src, dst)
+	out, err := exec.CommandContext(ctx, "scp", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	return nil
+}
+
+// WaitReady polls the target until it accepts ssh connections, or ctx is done
+func (t *Target) WaitReady(ctx context.Context) error {
+	for {
+		err := exec.CommandContext(ctx, "ssh", t.sshArgs("true")...).Run()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("ssh not ready: %v", err)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
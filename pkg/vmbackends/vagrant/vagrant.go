@@ -0,0 +1,304 @@
+package vagrant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"github.com/urfave/cli"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Name of the Vagrant snapshot taken by Checkpoint
+const checkpointName = "vm-spinner"
+
+// File storing the ssh configuration of the VM, in its folder
+const sshConfigFile = "ssh-config"
+
+// Time given to cancelled vagrant commands to roll back (eg: to release the locks of the provider) before being killed
+const cancelGracePeriod = time.Minute
+
+const defaultVagrantfile = `
+Vagrant.configure("2") do |config|
+  config.vm.box = "{{ .BoxName }}"
+  config.vm.synced_folder ".", "/vagrant", disabled: true
+{{ .ProviderConfig }}
+end
+`
+
+// Resources configuration block for each supported provider,
+// as each of them uses its own keys and value types
+var providerConfigs = map[string]string{
+	"virtualbox": `  config.vm.provider "virtualbox" do |vb|
+    vb.memory = "{{ .Memory }}"
+    vb.cpus = "{{ .CPUs }}"
+  end`,
+	"libvirt": `  config.vm.provider "libvirt" do |libvirt|
+    libvirt.memory = {{ .Memory }}
+    libvirt.cpus = {{ .CPUs }}
+  end`,
+	"vmware_desktop": `  config.vm.provider "vmware_desktop" do |vmware|
+    vmware.vmx["memsize"] = "{{ .Memory }}"
+    vmware.vmx["numvcpus"] = "{{ .CPUs }}"
+  end`,
+	"hyperv": `  config.vm.provider "hyperv" do |hv|
+    hv.memory = {{ .Memory }}
+    hv.maxmemory = {{ .Memory }}
+    hv.cpus = {{ .CPUs }}
+  end`,
+	"parallels": `  config.vm.provider "parallels" do |prl|
+    prl.memory = {{ .Memory }}
+    prl.cpus = {{ .CPUs }}
+  end`,
+}
+
+type vagrantBackend struct {
+	template       *template.Template
+	providerConfig *template.Template
+	vars           map[string]string
+}
+
+// templateData is what Vagrantfile templates are executed on
+type templateData struct {
+	*vmbackends.VMConfig
+	// ProviderConfig is the provider block setting the VM resources
+	ProviderConfig string
+	Vars           map[string]string
+}
+
+type vagrantVM struct {
+	conf *vmbackends.VMConfig
+}
+
+func init() {
+	b := &vagrantBackend{}
+	_ = vmbackends.RegisterBackend(b.String(), b)
+}
+
+func (b *vagrantBackend) String() string {
+	return "vagrant"
+}
+
+func (b *vagrantBackend) Desc() string {
+	return "Run VMs through Vagrant, on any of its providers."
+}
+
+func (b *vagrantBackend) Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name: "vagrantfile-template",
+			Usage: "Go text/template file used to generate the Vagrantfile of each VM. " +
+				"It can access the VM config (eg: '{{ .BoxName }}', '{{ .Memory }}'), the provider resources block ('{{ .ProviderConfig }}') and the variables set with --var (eg: '{{ .Vars.key }}').",
+		},
+		cli.StringSliceFlag{
+			Name:  "var",
+			Usage: "Variable available to the Vagrantfile template, in the 'key=value' form. Specify it multiple times for multiple variables.",
+		},
+	}
+}
+
+func (b *vagrantBackend) ParseCfg(c *cli.Context) error {
+	provider := c.GlobalString("provider")
+	providerConfig, ok := providerConfigs[provider]
+	if !ok {
+		var providers []string
+		for p := range providerConfigs {
+			providers = append(providers, p)
+		}
+		sort.Strings(providers)
+		return fmt.Errorf("unsupported provider '%s', between { %s }", provider, strings.Join(providers, ", "))
+	}
+	b.providerConfig = template.Must(template.New(provider).Parse(providerConfig))
+
+	var err error
+	if c.GlobalIsSet("vagrantfile-template") {
+		path := c.GlobalString("vagrantfile-template")
+		b.template, err = template.New(filepath.Base(path)).Option("missingkey=error").ParseFiles(path)
+	} else {
+		b.template, err = template.New("Vagrantfile").Parse(defaultVagrantfile)
+	}
+	if err != nil {
+		return err
+	}
+
+	b.vars = make(map[string]string)
+	for _, v := range c.GlobalStringSlice("var") {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return fmt.Errorf("wrong variable '%s', expected 'key=value'", v)
+		}
+		b.vars[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+func (b *vagrantBackend) Create(ctx context.Context, conf *vmbackends.VMConfig, info chan<- string) (vmbackends.VM, error) {
+	// Create Vagrant config file
+	vmbackends.SendStr(info, "Initializing Vagrant configuration for '"+conf.BoxName+"'")
+	err := os.MkdirAll(conf.Path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// VMs restored from a snapshot are created from the box it was packaged into
+	if conf.Snapshot != nil {
+		c := *conf
+		c.BoxName = snapshotBox(conf.Snapshot)
+		conf = &c
+	}
+
+	var providerConfig, vagrantfile strings.Builder
+	err = b.providerConfig.Execute(&providerConfig, conf)
+	if err != nil {
+		return nil, err
+	}
+	err = b.template.Execute(&vagrantfile, templateData{
+		VMConfig:       conf,
+		ProviderConfig: providerConfig.String(),
+		Vars:           b.vars,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(conf.Path, "Vagrantfile"), []byte(vagrantfile.String()), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &vagrantVM{conf: conf}, nil
+}
+
+// snapshotBox returns the name of the box s is packaged into
+func snapshotBox(s *vmbackends.Snapshot) string {
+	return "vm-spinner/" + s.Name
+}
+
+// DeleteSnapshot removes the box s is packaged into
+func (b *vagrantBackend) DeleteSnapshot(ctx context.Context, s *vmbackends.Snapshot, info chan<- string) error {
+	out, err := exec.CommandContext(ctx, "vagrant", "box", "list").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	if !strings.Contains(string(out), snapshotBox(s)+" ") {
+		return nil
+	}
+	return vmbackends.RunCmd(exec.CommandContext(ctx, "vagrant", "box", "remove", "--force", "--all", snapshotBox(s)), info)
+}
+
+// Snapshot packages the VM into a new box, since Vagrant snapshots
+// can't be shared by multiple VMs running at the same time
+func (v *vagrantVM) Snapshot(ctx context.Context, s *vmbackends.Snapshot, info chan<- string) error {
+	box := filepath.Join(s.Dir, "package.box")
+	_ = os.Remove(box)
+	err := v.vagrant(ctx, info, "package", "--output", box)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(box)
+	return v.vagrant(ctx, info, "box", "add", "--force", "--name", snapshotBox(s), box)
+}
+
+// Load reattaches to a Vagrant environment, all of its state is in its folder
+func (b *vagrantBackend) Load(ctx context.Context, conf *vmbackends.VMConfig) (vmbackends.VM, error) {
+	if _, err := os.Stat(filepath.Join(conf.Path, "Vagrantfile")); err != nil {
+		return nil, err
+	}
+	return &vagrantVM{conf: conf}, nil
+}
+
+func (v *vagrantVM) ShellCmd() string {
+	return "cd " + vmbackends.ShellQuote(v.conf.Path) + " && vagrant ssh"
+}
+
+func (v *vagrantVM) Boot(ctx context.Context, info chan<- string) error {
+	return v.vagrant(ctx, info, "up", "--provider", v.conf.ProviderName)
+}
+
+func (v *vagrantVM) Exec(ctx context.Context, cmd string, output chan<- string) error {
+	return v.vagrant(ctx, output, "ssh", "-c", cmd)
+}
+
+// ExecStreams relies on 'vagrant ssh' printing the remote stdout and stderr to its own ones
+func (v *vagrantVM) ExecStreams(ctx context.Context, cmd string, stdout, stderr chan<- string) error {
+	return vmbackends.RunCmdStreams(v.command(ctx, "ssh", "-c", cmd), stdout, stderr)
+}
+
+func (v *vagrantVM) Copy(ctx context.Context, src, dst string, info chan<- string) error {
+	return v.vagrant(ctx, info, "upload", src, dst)
+}
+
+// Download copies src through scp, as vagrant is only able to upload files
+func (v *vagrantVM) Download(ctx context.Context, src, dst string, info chan<- string) error {
+	config, err := v.command(ctx, "ssh-config").Output()
+	if err != nil {
+		return fmt.Errorf("can't get ssh config: %w", err)
+	}
+	// The host is named after the Vagrant machine
+	host := ""
+	for _, l := range strings.Split(string(config), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 2 && fields[0] == "Host" {
+			host = fields[1]
+			break
+		}
+	}
+	if len(host) == 0 {
+		return errors.New("no host found in ssh config")
+	}
+	configFile := filepath.Join(v.conf.Path, sshConfigFile)
+	err = os.WriteFile(configFile, config, 0644)
+	if err != nil {
+		return err
+	}
+	out, err := exec.CommandContext(ctx, "scp", "-F", configFile, "-r", host+":"+src, dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	return nil
+}
+
+func (v *vagrantVM) Halt(ctx context.Context, info chan<- string) error {
+	return v.vagrant(ctx, info, "halt")
+}
+
+// Checkpoint takes a Vagrant snapshot of the running VM
+func (v *vagrantVM) Checkpoint(ctx context.Context, info chan<- string) error {
+	return v.vagrant(ctx, info, "snapshot", "save", "--force", checkpointName)
+}
+
+// Reset restores the Vagrant snapshot taken by Checkpoint
+func (v *vagrantVM) Reset(ctx context.Context, info chan<- string) error {
+	return v.vagrant(ctx, info, "snapshot", "restore", "--no-provision", checkpointName)
+}
+
+func (v *vagrantVM) Destroy(ctx context.Context, info chan<- string) error {
+	// Nothing to destroy if the Vagrant environment was never created
+	if _, err := os.Stat(filepath.Join(v.conf.Path, "Vagrantfile")); os.IsNotExist(err) {
+		return nil
+	}
+	return v.vagrant(ctx, info, "destroy", "--force")
+}
+
+// vagrant runs a vagrant command in the VM folder, sending its output lines to output.
+// The command gets killed once ctx is done.
+func (v *vagrantVM) vagrant(ctx context.Context, output chan<- string, args ...string) error {
+	return vmbackends.RunCmd(v.command(ctx, args...), output)
+}
+
+// command returns a vagrant command to be run in the VM folder.
+// Once ctx is done, the command is interrupted as with Ctrl+C, and only killed if it does not exit within cancelGracePeriod.
+func (v *vagrantVM) command(ctx context.Context, args ...string) *exec.Cmd {
+	c := exec.CommandContext(ctx, "vagrant", args...)
+	c.Dir = v.conf.Path
+	c.Env = append(os.Environ(), "VAGRANT_CHECKPOINT_DISABLE=1")
+	c.Cancel = func() error {
+		return c.Process.Signal(os.Interrupt)
+	}
+	c.WaitDelay = cancelGracePeriod
+	return c
+}
@@ -0,0 +1,165 @@
+package vmbackends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs"
+	"github.com/urfave/cli"
+	"sort"
+	"time"
+)
+
+type VMConfig struct {
+	Path         string
+	BoxName      string
+	ProviderName string
+	Memory       int
+	CPUs         int
+	Job          vmjobs.VMJob
+	// Timeouts of the lifecycle phases, zero means no timeout
+	BootTimeout     time.Duration
+	JobTimeout      time.Duration
+	TeardownTimeout time.Duration
+	// BootRetry -> how failed creations and boots of the VM are retried
+	BootRetry RetryPolicy
+	// Keep -> when the VM is kept alive after the job, in place of being torn down
+	Keep KeepPolicy
+	// SnapshotDir -> if set, VMs running jobs that implement vmjobs.VMJobProvisioner are created from snapshots
+	// saved in this folder, once provisioned. Snapshots are saved the first time they are needed.
+	SnapshotDir string
+	// ArtifactsDir -> local folder the artifacts of jobs implementing vmjobs.VMJobCollector are downloaded to.
+	// It is created when the first artifact is downloaded, and no artifact is downloaded if it is not set.
+	ArtifactsDir string
+	// Snapshot -> snapshot to create the VM from, if any. Set by RunVirtualMachine for the backends supporting it.
+	Snapshot *Snapshot
+}
+
+// KeepPolicy -> when VMs are kept alive after their job, eg: for post-mortem debugging
+type KeepPolicy string
+
+const (
+	KeepNever     KeepPolicy = "never"
+	KeepOnFailure KeepPolicy = "on-failure"
+	KeepAlways    KeepPolicy = "always"
+)
+
+// VMBackendConfigurator -> implements this interface to declare global flags for your backend and eventually parse them
+type VMBackendConfigurator interface {
+	// Flags -> list of cli.Flag supported specifically by the backend.
+	// They are added to the global flags, thus their names must not clash with other backends ones.
+	Flags() []cli.Flag
+	// ParseCfg -> called when program starts, if the backend is selected, to parse backend specific config
+	ParseCfg(c *cli.Context) error
+}
+
+// VMBackendKernelSharer -> implements this interface to declare that your backend runs
+// jobs on the host kernel, thus refusing jobs that depend on the VM kernel
+type VMBackendKernelSharer interface {
+	// SharesHostKernel -> whether the backend runs jobs on the host kernel
+	SharesHostKernel() bool
+}
+
+// VMBackendMemorySharer -> implements this interface if the VMs of your backend reserve no memory on the host,
+// eg: processes taking it as they need. VMs of backends sharing the host memory are scheduled by their CPUs only.
+type VMBackendMemorySharer interface {
+	// SharesHostMemory -> whether the VMs of the backend take memory from the host as they need, in place of reserving it
+	SharesHostMemory() bool
+}
+
+// VMBackendLoader -> implements this interface to let VMs kept alive by a previous run be reattached, eg: to destroy them.
+// Backends implementing it must store all the state they need in the VM path, as ParseCfg might not be called beforehand.
+type VMBackendLoader interface {
+	// Load -> reattaches to the VM previously created from conf
+	Load(ctx context.Context, conf *VMConfig) (VM, error)
+}
+
+// VMBackend -> mandatory interface to be implemented by each backend
+type VMBackend interface {
+	// Stringer -> name for the backend, used as value for the "backend" flag
+	fmt.Stringer
+	// Desc -> backend description
+	Desc() string
+	// Create -> creates a new VM described by conf, without booting it.
+	// Progress lines might be sent to info.
+	Create(ctx context.Context, conf *VMConfig, info chan<- string) (VM, error)
+}
+
+// VM -> a single virtual machine, as created by a VMBackend.
+// All the operations must return as soon as possible once their ctx is done.
+type VM interface {
+	// Boot -> starts the VM up, and returns once it is ready to run commands
+	Boot(ctx context.Context, info chan<- string) error
+	// Exec -> runs cmd in the VM, sending each line of its output to output
+	Exec(ctx context.Context, cmd string, output chan<- string) error
+	// Copy -> copies the local file or directory src to dst in the VM
+	Copy(ctx context.Context, src, dst string, info chan<- string) error
+	// Halt -> stops the VM
+	Halt(ctx context.Context, info chan<- string) error
+	// Destroy -> deletes the VM and all its resources
+	Destroy(ctx context.Context, info chan<- string) error
+}
+
+// VMShellCommander -> implements this interface to let users open a shell in your VMs, eg: in VMs kept alive after a failure
+type VMShellCommander interface {
+	// ShellCmd -> host command line opening an interactive shell in the VM
+	ShellCmd() string
+}
+
+// VMStreamer -> implements this interface to tell the stdout and stderr of the job commands apart.
+// All the output of VMs not implementing it is reported as stdout.
+type VMStreamer interface {
+	// ExecStreams -> runs cmd in the VM as Exec, sending each line of its stdout and stderr to the respective channel
+	ExecStreams(ctx context.Context, cmd string, stdout, stderr chan<- string) error
+}
+
+// VMDownloader -> implements this interface to let jobs download files out of your VMs, eg: build products.
+// Artifacts of jobs running on VMs not implementing it are skipped.
+type VMDownloader interface {
+	// Download -> copies the file or directory src of the VM, an absolute path, to the local dst, which does not exist yet
+	Download(ctx context.Context, src, dst string, info chan<- string) error
+}
+
+// VMResetter -> implements this interface to let your VMs run several jobs one after the other, eg: in the VM pool of the daemon.
+// VMs not implementing it are destroyed and replaced by new ones after each job.
+type VMResetter interface {
+	// Checkpoint -> saves the state of the running VM, once booted
+	Checkpoint(ctx context.Context, info chan<- string) error
+	// Reset -> brings the running VM back to the state saved by Checkpoint
+	Reset(ctx context.Context, info chan<- string) error
+}
+
+var (
+	backends           = make(map[string]VMBackend)
+	alreadyExistentErr = errors.New("backend already registered")
+	backendNotFoundFmt = "backend '%s' not found"
+	DefaultBackend     = "vagrant"
+)
+
+// RegisterBackend is used by backends to register themselves in their init()
+func RegisterBackend(name string, backend VMBackend) error {
+	if _, ok := backends[name]; !ok {
+		backends[name] = backend
+		return nil
+	}
+	return alreadyExistentErr
+}
+
+// ListBackends returns all the registered backends, sorted by name
+func ListBackends() []VMBackend {
+	bSlice := make([]VMBackend, 0, len(backends))
+	for _, b := range backends {
+		bSlice = append(bSlice, b)
+	}
+	sort.Slice(bSlice, func(i, j int) bool {
+		return bSlice[i].String() < bSlice[j].String()
+	})
+	return bSlice
+}
+
+func GetBackend(name string) (VMBackend, error) {
+	if b, ok := backends[name]; ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf(backendNotFoundFmt, name)
+}
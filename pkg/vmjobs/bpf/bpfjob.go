@@ -4,6 +4,7 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
 	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs"
 	"github.com/olekukonko/tablewriter"
 	"github.com/urfave/cli"
@@ -18,11 +19,27 @@ type bpfInfo struct {
 	scapBuilt  bool
 	probeBuilt bool
 	res        string
+	// status -> summary of the result of the VM
+	status string
 }
 
 type BuildTestJob struct {
 	Table   *tablewriter.Table
 	Command string
+	// Provisioning -> installs the build dependencies, that do not depend on the libs version
+	Provisioning string
+	// LibsDir -> local libs source tree uploaded into the VMs in place of cloning it, if set
+	LibsDir string
+}
+
+// Folder the local libs source tree is uploaded to, where the job would otherwise clone it
+const libsUploadDst = "libs"
+
+// buildArtifacts -> built drivers and build logs, downloaded out of the VMs
+var buildArtifacts = []string{
+	"libs/build/driver/bpf/probe.o",
+	"libs/build/driver/*.ko",
+	"libs/build/CMakeFiles/*.log",
 }
 
 type bpfJob struct {
@@ -40,6 +57,12 @@ var bpfDefaultImages = cli.StringSlice{
 	"bento/amazonlinux-2",
 }
 
+//go:embed scripts/common.sh
+var commonFuncs string
+
+//go:embed scripts/install_deps.sh
+var installDepsCmdFmt string
+
 //go:embed scripts/bpf_kmod_job.sh
 var bpfKmodCmdFmt string
 
@@ -61,12 +84,12 @@ func (j *bpfJob) Flags() []cli.Flag {
 }
 
 func (j *bpfJob) ParseCfg(c *cli.Context) error {
-	btJob, err := NewBuildTestJob(c, true, []string{"VM", "Clang", "Linux", "Scap_built", "Probe_built", "Res"})
+	btJob, err := NewBuildTestJob(c, true, []string{"VM", "Clang", "Linux", "Scap_built", "Probe_built", "Res", "Status"})
 	if err != nil {
 		return err
 	}
 	j.BuildTestJob = btJob
-	j.bpfInfos = initBpfInfoMap(c.StringSlice("image"))
+	j.bpfInfos = initBpfInfoMap(vmjobs.ImageNames(c.StringSlice("image")))
 	return nil
 }
 
@@ -74,8 +97,20 @@ func (j *bpfJob) Cmd() (string, bool) {
 	return j.Command, false
 }
 
-func (j *bpfJob) Process(VM, outputLine string) {
-	outputs := strings.Split(outputLine, ": ")
+// NeedsKernel is true, since the job builds against the running kernel
+func (j *bpfJob) NeedsKernel() bool {
+	return true
+}
+
+// ProcessLine parses the results printed to stdout, ignoring stderr, eg: compiler errors
+func (j *bpfJob) ProcessLine(VM string, line vmjobs.OutputLine) {
+	if line.Stream != vmjobs.StreamStdout {
+		return
+	}
+	outputs := strings.SplitN(line.Text, ": ", 2)
+	if len(outputs) < 2 {
+		return
+	}
 	info := j.bpfInfos[VM]
 	switch outputs[0] {
 	case "CLANG_VERSION":
@@ -91,12 +126,18 @@ func (j *bpfJob) Process(VM, outputLine string) {
 	}
 }
 
+// ProcessResult records the status of each VM, eg: whether it failed before printing any test outcome
+func (j *bpfJob) ProcessResult(res *vmjobs.VMResult) {
+	j.bpfInfos[res.VM].status = res.Summary()
+}
+
 func (j *bpfJob) Done() {
 	for vm, info := range j.bpfInfos {
 		j.Table.Append([]string{vm, info.clang, info.linux,
 			strconv.FormatBool(info.scapBuilt),
 			strconv.FormatBool(info.probeBuilt),
-			info.res})
+			info.res,
+			info.status})
 	}
 	j.Table.Render()
 }
@@ -104,6 +145,7 @@ func (j *bpfJob) Done() {
 func NewBuildTestJob(c *cli.Context, isBpf bool, headers []string) (BuildTestJob, error) {
 	commitHash := c.String("commithash")
 	forkName := c.String("forkname")
+	libsDir := c.String("libs-dir")
 
 	if len(commitHash) == 0 {
 		return BuildTestJob{}, errors.New("empty 'commithash' value")
@@ -111,6 +153,11 @@ func NewBuildTestJob(c *cli.Context, isBpf bool, headers []string) (BuildTestJob
 	if len(forkName) == 0 {
 		return BuildTestJob{}, errors.New("empty 'forkname' value")
 	}
+	if len(libsDir) > 0 {
+		if info, err := os.Stat(libsDir); err != nil || !info.IsDir() {
+			return BuildTestJob{}, fmt.Errorf("wrong 'libs-dir' value '%s': not a directory", libsDir)
+		}
+	}
 
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetHeader(headers)
@@ -118,11 +165,34 @@ func NewBuildTestJob(c *cli.Context, isBpf bool, headers []string) (BuildTestJob
 	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
 	table.SetCenterSeparator("|")
 	return BuildTestJob{
-		Table:   table,
-		Command: fmt.Sprintf(bpfKmodCmdFmt, forkName, commitHash, isBpf),
+		Table:        table,
+		Command:      commonFuncs + fmt.Sprintf(bpfKmodCmdFmt, vmbackends.ShellQuote(forkName), vmbackends.ShellQuote(commitHash), len(libsDir) > 0, isBpf),
+		Provisioning: commonFuncs + fmt.Sprintf(installDepsCmdFmt, isBpf),
+		LibsDir:      libsDir,
 	}, nil
 }
 
+// Provision installs the build dependencies, so that VMs can be snapshotted with them
+func (j *BuildTestJob) Provision() []string {
+	if len(j.Provisioning) == 0 {
+		return nil
+	}
+	return []string{j.Provisioning}
+}
+
+// Uploads uploads the local libs source tree, if any
+func (j *BuildTestJob) Uploads() []vmjobs.Upload {
+	if len(j.LibsDir) == 0 {
+		return nil
+	}
+	return []vmjobs.Upload{{Src: j.LibsDir, Dst: libsUploadDst}}
+}
+
+// Artifacts downloads the built drivers, and the logs of the build
+func (j *BuildTestJob) Artifacts() []string {
+	return buildArtifacts
+}
+
 // Preinitialize map with meaningful values so that we will access it readonly,
 // and there will be no need for concurrent access strategies
 func initBpfInfoMap(images []string) map[string]*bpfInfo {
@@ -134,6 +204,7 @@ func initBpfInfoMap(images []string) map[string]*bpfInfo {
 			scapBuilt:  false,
 			probeBuilt: false,
 			res:        "N/A",
+			status:     "N/A",
 		}
 	}
 	return bpfInfos
@@ -156,5 +227,9 @@ func FlagsForBpfKmodTest(defImages *cli.StringSlice) []cli.Flag {
 			Usage: "libs commit hash to run the test against.",
 			Value: "master",
 		},
+		cli.StringFlag{
+			Name:  "libs-dir",
+			Usage: "local libs source tree to run the test against, eg: with uncommitted changes. It is uploaded into each VM in place of cloning 'forkname' at 'commithash'.",
+		},
 	}
 }
@@ -0,0 +1,92 @@
+package bpf
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends/fake"
+	"github.com/urfave/cli"
+)
+
+func TestBpfJob(t *testing.T) {
+	j := &bpfJob{
+		BuildTestJob: BuildTestJob{Command: "build_and_run"},
+		bpfInfos:     initBpfInfoMap([]string{"built", "broken", "down"}),
+	}
+	fake.RunJobs(context.Background(), j, t.TempDir(), map[string]fake.Responder{
+		"built": fake.ScriptedResponder([]string{
+			"CLANG_VERSION: 14.0.6",
+			"LINUX_VERSION: 5.15.0-generic",
+			"SCAP_BUILT: true",
+			"PROBE_BUILT: true",
+			"VERIFIER_TEST: 0",
+		}),
+		"broken": fake.ScriptedResponder([]string{
+			"CLANG_VERSION: 7.0.1",
+			"SCAP_BUILT: true",
+			"not a result line",
+			"ERROR: probe build failed",
+		}),
+		"down": func(ctx context.Context, VM, cmd string, output chan<- string) error {
+			return errors.New("connection closed")
+		},
+	})
+
+	tests := []struct {
+		vm   string
+		want bpfInfo
+	}{
+		{"built", bpfInfo{clang: "14.0.6", linux: "5.15.0-generic", scapBuilt: true, probeBuilt: true, res: "0", status: "succeeded"}},
+		{"broken", bpfInfo{clang: "7.0.1", linux: "N/A", scapBuilt: true, res: "probe build failed", status: "succeeded"}},
+		{"down", bpfInfo{clang: "N/A", linux: "N/A", res: "N/A", status: "job failed"}},
+	}
+	for _, tt := range tests {
+		if got := *j.bpfInfos[tt.vm]; got != tt.want {
+			t.Errorf("%s: got %+v, expected %+v", tt.vm, got, tt.want)
+		}
+	}
+}
+
+func TestBuildTestJobQuoting(t *testing.T) {
+	tests := []struct {
+		forkName   string
+		commitHash string
+	}{
+		{"falcosecurity", "master"},
+		{"it's", "0.10.x"},
+		{"$(touch pwned)", "`id`; rm -rf ~"},
+		{`"'\"`, "a b"},
+	}
+	for _, tt := range tests {
+		var job BuildTestJob
+		app := cli.NewApp()
+		app.Flags = FlagsForBpfKmodTest(&cli.StringSlice{})
+		app.Action = func(c *cli.Context) (err error) {
+			job, err = NewBuildTestJob(c, true, nil)
+			return
+		}
+		err := app.Run([]string{"bpf", "--forkname", tt.forkName, "--commithash", tt.commitHash})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Evaluate the variables assignments of the command, as the VM shell would
+		var vars []string
+		for _, l := range strings.Split(job.Command, "\n") {
+			if strings.HasPrefix(l, "fork_name=") || strings.HasPrefix(l, "commit_hash=") {
+				vars = append(vars, l)
+			}
+		}
+		script := strings.Join(vars, "\n") + "\nprintf '%s\\n%s' \"$fork_name\" \"$commit_hash\""
+		out, err := exec.Command("sh", "-c", script).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%q: %s: %s", tt.forkName, err, out)
+		}
+		if want := tt.forkName + "\n" + tt.commitHash; string(out) != want {
+			t.Errorf("variables evaluate to %q, expected %q", out, want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+install_deps() {
+    lsb_dist=$( get_distribution )
+    lsb_dist="$(echo "$lsb_dist" | tr '[:upper:]' '[:lower:]')"
+
+    case "$lsb_dist" in
+        ubuntu|debian) # OK ubuntu/focal64, OK ubuntu/bionic64, OK generic/debian10
+            sudo apt update
+            sudo apt install linux-headers-"$(uname -r)" git cmake build-essential pkg-config autoconf libtool libelf-dev -y
+            if [ "$is_bpf" = true ]
+            then
+                sudo apt install llvm clang -y
+            fi
+            ;;
+        centos|rhel|amzn) # OK generic/centos8, OK bento/amazonlinux-2
+            sudo yum makecache
+            sudo yum install gcc gcc-c++ kernel-devel-"$(uname -r)" git cmake pkg-config autoconf libtool elfutils-libelf-devel llvm clang -y
+            if [ "$is_bpf" = true ]
+            then
+                sudo yum install llvm clang -y
+            fi
+            ;;
+        fedora) # OK generic/fedora33
+            sudo dnf upgrade --refresh -y
+            sudo dnf install gcc gcc-c++ kernel-headers git cmake pkg-config autoconf libtool elfutils-libelf-devel llvm clang -y
+            if [ "$is_bpf" = true ]
+            then
+                sudo dnf install llvm clang -y
+            fi
+            ;;
+        arch*) # OK generic/arch libvirt
+            sudo pacman -Sy
+            sudo pacman -S linux-headers git cmake base-devel elfutils --noconfirm
+            if [ "$is_bpf" = true ]
+            then
+                sudo pacman -S llvm clang --noconfirm
+            fi
+            ;;
+        alpine) # OK generic/alpine314
+            sudo apk update
+            sudo apk add linux-virt-dev linux-headers g++ gcc cmake make git autoconf automake m4 libtool elfutils-dev libelf-static patch binutils
+            if [ "$is_bpf" = true ]
+            then
+                sudo apk add llvm clang
+            fi
+            ;;
+        opensuse-*) # ??
+            sudo zypper refresh
+            sudo zypper -n install kernel-default-devel gcc gcc-c++ git-core cmake patch which automake autoconf libtool libelf-devel
+            if [ "$is_bpf" = true ]
+            then
+                sudo zypper -n install llvm clang
+            fi
+            ;;
+        *)
+            echo
+            echo "ERROR: Unsupported distribution '$lsb_dist'"
+            echo
+            exit 1
+            ;;
+    esac
+}
+
+set -e
+is_bpf=%v
+
+install_deps
@@ -2,13 +2,19 @@ package cmd
 
 import (
 	"bufio"
+	"fmt"
 	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs"
 	"github.com/urfave/cli"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 type cmdLineJob struct {
-	cmd string
+	cmd       string
+	provision []string
+	uploads   []vmjobs.Upload
+	collect   []string
 }
 
 func init() {
@@ -34,6 +40,20 @@ func (j *cmdLineJob) Flags() []cli.Flag {
 			Name:  "file",
 			Usage: "script that runs in each VM, as a filepath.",
 		},
+		cli.StringSliceFlag{
+			Name:  "provision",
+			Usage: "command that sets each VM up before the job, specify it multiple times for multiple commands. VMs are provisioned once per image when using snapshots.",
+		},
+		cli.StringSliceFlag{
+			Name: "upload",
+			Usage: "local file or directory copied into each VM before the job, as 'src:dst', or 'src' to copy it with the same name. " +
+				"Relative destinations are relative to the directory the command runs in. Specify it multiple times for multiple uploads.",
+		},
+		cli.StringSliceFlag{
+			Name: "collect",
+			Usage: "path in each VM, or shell glob, downloaded into the --artifacts-dir folder once the command is done, even if it failed. " +
+				"Relative paths are relative to the directory the command runs in. Specify it multiple times for multiple paths.",
+		},
 	}
 }
 
@@ -42,6 +62,19 @@ func (j *cmdLineJob) ParseCfg(c *cli.Context) error {
 		err  error
 		file = os.Stdin
 	)
+	j.provision = c.StringSlice("provision")
+	j.collect = c.StringSlice("collect")
+	j.uploads = nil
+	for _, spec := range c.StringSlice("upload") {
+		src, dst, found := strings.Cut(spec, ":")
+		if !found {
+			dst = filepath.Base(src)
+		}
+		if _, err := os.Stat(src); err != nil {
+			return fmt.Errorf("wrong upload value '%s': %s", spec, err)
+		}
+		j.uploads = append(j.uploads, vmjobs.Upload{Src: src, Dst: dst})
+	}
 	switch {
 	case c.IsSet("line"):
 		j.cmd = c.String("line")
@@ -64,3 +97,15 @@ func (j *cmdLineJob) ParseCfg(c *cli.Context) error {
 func (j *cmdLineJob) Cmd() (string, bool) {
 	return j.cmd, false
 }
+
+func (j *cmdLineJob) Provision() []string {
+	return j.provision
+}
+
+func (j *cmdLineJob) Uploads() []vmjobs.Upload {
+	return j.uploads
+}
+
+func (j *cmdLineJob) Artifacts() []string {
+	return j.collect
+}
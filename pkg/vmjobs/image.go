@@ -0,0 +1,58 @@
+package vmjobs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Image -> a VM image, as specified through the "image" flag, with its optional resources overrides.
+// Zero CPUs or Memory mean that the global value applies.
+type Image struct {
+	Name   string
+	CPUs   int
+	Memory int
+}
+
+// ParseImage parses an "image" flag value, in the "name[:cpus=N,mem=M]" form
+func ParseImage(spec string) (Image, error) {
+	img := Image{Name: spec}
+	idx := strings.LastIndex(spec, ":")
+	// Colons are allowed in image names too (eg: container image tags),
+	// overrides are only recognized when made of key=value pairs
+	if idx < 0 || !strings.Contains(spec[idx+1:], "=") {
+		return img, nil
+	}
+
+	img.Name = spec[:idx]
+	for _, kv := range strings.Split(spec[idx+1:], ",") {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return img, fmt.Errorf("wrong override '%s' for image '%s', expected 'key=value'", kv, img.Name)
+		}
+		val, err := strconv.Atoi(pair[1])
+		if err != nil || val <= 0 {
+			return img, fmt.Errorf("wrong value '%s' for '%s' override of image '%s'", pair[1], pair[0], img.Name)
+		}
+		switch pair[0] {
+		case "cpus":
+			img.CPUs = val
+		case "mem", "memory":
+			img.Memory = val
+		default:
+			return img, fmt.Errorf("unknown override '%s' for image '%s', between { cpus, mem }", pair[0], img.Name)
+		}
+	}
+	return img, nil
+}
+
+// ImageNames returns the image names of "image" flag values, stripping their resources overrides.
+// Jobs should use it to know the VM names their output lines will refer to.
+func ImageNames(specs []string) []string {
+	names := make([]string, 0, len(specs))
+	for _, s := range specs {
+		img, _ := ParseImage(s)
+		names = append(names, img.Name)
+	}
+	return names
+}
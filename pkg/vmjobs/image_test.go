@@ -0,0 +1,38 @@
+package vmjobs
+
+import "testing"
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Image
+		wantErr bool
+	}{
+		{spec: "ubuntu/focal64", want: Image{Name: "ubuntu/focal64"}},
+		{spec: "ubuntu/focal64:cpus=2", want: Image{Name: "ubuntu/focal64", CPUs: 2}},
+		{spec: "ubuntu/focal64:mem=2048", want: Image{Name: "ubuntu/focal64", Memory: 2048}},
+		{spec: "ubuntu/focal64:cpus=4,memory=8192", want: Image{Name: "ubuntu/focal64", CPUs: 4, Memory: 8192}},
+		{spec: "alpine:3.17", want: Image{Name: "alpine:3.17"}},
+		{spec: "alpine:3.17:cpus=1", want: Image{Name: "alpine:3.17", CPUs: 1}},
+		{spec: "ubuntu/focal64:cpus=0", wantErr: true},
+		{spec: "ubuntu/focal64:cpus=two", wantErr: true},
+		{spec: "ubuntu/focal64:disk=10", wantErr: true},
+		{spec: "ubuntu/focal64:cpus=2,mem", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseImage(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseImage(%q): expected an error, got %+v", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseImage(%q): unexpected error: %s", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseImage(%q) = %+v, expected %+v", tt.spec, got, tt.want)
+		}
+	}
+}
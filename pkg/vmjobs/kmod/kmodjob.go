@@ -12,6 +12,8 @@ type kmodInfo struct {
 	gcc       string
 	linux     string
 	kmodBuilt bool
+	// status -> summary of the result of the VM
+	status string
 }
 
 type kmodJob struct {
@@ -43,6 +45,7 @@ func initKmodInfoMap(images []string) map[string]*kmodInfo {
 			gcc:       "N/A",
 			linux:     "N/A",
 			kmodBuilt: false,
+			status:    "N/A",
 		}
 	}
 	return kmodInfos
@@ -61,12 +64,12 @@ func (j *kmodJob) Flags() []cli.Flag {
 }
 
 func (j *kmodJob) ParseCfg(c *cli.Context) error {
-	btJob, err := bpf.NewBuildTestJob(c, false, []string{"VM", "GCC", "Linux", "Kmod_built"})
+	btJob, err := bpf.NewBuildTestJob(c, false, []string{"VM", "GCC", "Linux", "Kmod_built", "Status"})
 	if err != nil {
 		return err
 	}
 	j.BuildTestJob = btJob
-	j.kmodInfos = initKmodInfoMap(c.StringSlice("image"))
+	j.kmodInfos = initKmodInfoMap(vmjobs.ImageNames(c.StringSlice("image")))
 	return nil
 }
 
@@ -74,8 +77,20 @@ func (j *kmodJob) Cmd() (string, bool) {
 	return j.Command, false
 }
 
-func (j *kmodJob) Process(VM, outputLine string) {
-	outputs := strings.Split(outputLine, ": ")
+// NeedsKernel is true, since the job builds against the running kernel
+func (j *kmodJob) NeedsKernel() bool {
+	return true
+}
+
+// ProcessLine parses the results printed to stdout, ignoring stderr, eg: compiler errors
+func (j *kmodJob) ProcessLine(VM string, line vmjobs.OutputLine) {
+	if line.Stream != vmjobs.StreamStdout {
+		return
+	}
+	outputs := strings.SplitN(line.Text, ": ", 2)
+	if len(outputs) < 2 {
+		return
+	}
 	info := j.kmodInfos[VM]
 	switch outputs[0] {
 	case "GCC_VERSION":
@@ -87,10 +102,16 @@ func (j *kmodJob) Process(VM, outputLine string) {
 	}
 }
 
+// ProcessResult records the status of each VM, eg: whether it failed before printing any build outcome
+func (j *kmodJob) ProcessResult(res *vmjobs.VMResult) {
+	j.kmodInfos[res.VM].status = res.Summary()
+}
+
 func (j *kmodJob) Done() {
 	for vm, info := range j.kmodInfos {
 		j.Table.Append([]string{vm, info.gcc, info.linux,
-			strconv.FormatBool(info.kmodBuilt)})
+			strconv.FormatBool(info.kmodBuilt),
+			info.status})
 	}
 	j.Table.Render()
 }
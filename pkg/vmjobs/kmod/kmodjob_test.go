@@ -0,0 +1,41 @@
+package kmod
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends/fake"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmjobs/bpf"
+)
+
+// The failures of VMs are covered by the bpf job tests, as the two jobs share their script
+func TestKmodJob(t *testing.T) {
+	j := &kmodJob{
+		BuildTestJob: bpf.BuildTestJob{Command: "build_and_run"},
+		kmodInfos:    initKmodInfoMap([]string{"built", "broken"}),
+	}
+	fake.RunJobs(context.Background(), j, t.TempDir(), map[string]fake.Responder{
+		"built": fake.ScriptedResponder([]string{
+			"GCC_VERSION: 12.2.0",
+			"LINUX_VERSION: 6.1.0-amd64",
+			"DRIVER_BUILT: true",
+		}),
+		"broken": fake.ScriptedResponder([]string{
+			"GCC_VERSION: 4.8.5",
+			"ERROR: false",
+		}),
+	})
+
+	tests := []struct {
+		vm   string
+		want kmodInfo
+	}{
+		{"built", kmodInfo{gcc: "12.2.0", linux: "6.1.0-amd64", kmodBuilt: true, status: "succeeded"}},
+		{"broken", kmodInfo{gcc: "4.8.5", linux: "N/A", status: "succeeded"}},
+	}
+	for _, tt := range tests {
+		if got := *j.kmodInfos[tt.vm]; got != tt.want {
+			t.Errorf("%s: got %+v, expected %+v", tt.vm, got, tt.want)
+		}
+	}
+}
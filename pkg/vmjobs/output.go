@@ -0,0 +1,40 @@
+package vmjobs
+
+import "time"
+
+// Stream -> output stream of the job commands a line was printed to
+type Stream string
+
+const (
+	StreamStdout Stream = "stdout"
+	StreamStderr Stream = "stderr"
+)
+
+// OutputLine -> a line printed by the job commands
+type OutputLine struct {
+	Stream Stream
+	// Time -> when the line was received from the VM
+	Time time.Time
+	Text string
+}
+
+// processorAdapter -> lets a VMJobProcessor receive the lines of both streams, as plain strings
+type processorAdapter struct {
+	VMJobProcessor
+}
+
+func (a processorAdapter) ProcessLine(VM string, line OutputLine) {
+	a.Process(VM, line.Text)
+}
+
+// LineProcessor returns the VMJobLineProcessor of job, adapting its VMJobProcessor if it does not implement
+// VMJobLineProcessor itself, and whether job implements any of them
+func LineProcessor(job VMJob) (VMJobLineProcessor, bool) {
+	if p, ok := job.(VMJobLineProcessor); ok {
+		return p, true
+	}
+	if p, ok := job.(VMJobProcessor); ok {
+		return processorAdapter{p}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,95 @@
+package vmjobs
+
+import (
+	"fmt"
+	"time"
+)
+
+// VMPhase -> a phase of the lifecycle of a VM running a job
+type VMPhase string
+
+const (
+	VMPhaseCreate VMPhase = "create"
+	VMPhaseBoot   VMPhase = "boot"
+	// VMPhaseProvision -> provisioning the VM, for jobs implementing VMJobProvisioner
+	VMPhaseProvision VMPhase = "provision"
+	// VMPhaseUpload -> copying files into the VM, for jobs implementing VMJobUploader
+	VMPhaseUpload VMPhase = "upload"
+	VMPhaseJob    VMPhase = "job"
+	// VMPhaseDownload -> copying the artifacts out of the VM, for jobs implementing VMJobCollector
+	VMPhaseDownload VMPhase = "download"
+	VMPhaseHalt     VMPhase = "halt"
+	VMPhaseDestroy  VMPhase = "destroy"
+)
+
+// VMStatus -> final status of a job on a VM
+type VMStatus string
+
+const (
+	VMStatusSucceeded VMStatus = "succeeded"
+	VMStatusFailed    VMStatus = "failed"
+	// VMStatusCancelled -> the run was cancelled (eg: by a signal, or another VM failing in fail-fast mode)
+	VMStatusCancelled VMStatus = "cancelled"
+)
+
+// VMResult -> outcome of a job on a single VM
+type VMResult struct {
+	// VM -> name of the VM image, as passed to Process
+	VM     string
+	Status VMStatus
+	// FailedPhase -> phase that failed or got cancelled, empty if the job succeeded
+	FailedPhase VMPhase
+	Err         error
+	// ExitCode -> exit code of the last command sent to the VM, or -1 if it could not be run at all
+	ExitCode int
+	// ExitCodes -> exit codes of all the commands of the job sent to the VM, in order
+	ExitCodes []int
+	// BootAttempts -> number of times the VM was created and booted, including retries
+	BootAttempts int
+	Start        time.Time
+	End          time.Time
+	// Timings -> time spent in each of the phases that were reached
+	Timings map[VMPhase]time.Duration
+	// KeptPath -> path of the VM, if it was kept alive in place of being torn down
+	KeptPath string
+	// ShellCmd -> host command line opening a shell in the kept VM, if supported by the backend
+	ShellCmd string
+	// Stdout, Stderr -> last lines of the output of the job commands, as older ones are left out of long outputs.
+	// Backends unable to tell the two streams apart send everything to Stdout.
+	Stdout []string
+	Stderr []string
+	// DroppedStdoutLines, DroppedStderrLines -> number of older lines left out of Stdout and Stderr.
+	// They were delivered to the job anyway.
+	DroppedStdoutLines int
+	DroppedStderrLines int
+	// ArtifactsDir -> local folder the artifacts of the job were downloaded to, empty if none was
+	ArtifactsDir string
+	// DroppedDebugLines -> number of debug lines about the VM lifecycle that were not delivered, as nobody received them in time
+	DroppedDebugLines int
+}
+
+// VMJobResultProcessor -> implements this interface to receive the result of the job on each VM
+type VMJobResultProcessor interface {
+	// ProcessResult -> called once per VM, after all of its output lines have been processed
+	ProcessResult(res *VMResult)
+}
+
+func (r *VMResult) Failed() bool {
+	return r.Status != VMStatusSucceeded
+}
+
+// Summary returns a short human readable description of the result, eg: "boot failed"
+func (r *VMResult) Summary() string {
+	switch {
+	case !r.Failed():
+		return string(r.Status)
+	case r.Status == VMStatusCancelled:
+		return fmt.Sprintf("%s cancelled", r.FailedPhase)
+	case r.FailedPhase == VMPhaseJob && r.ExitCode > 0:
+		return fmt.Sprintf("%s failed (exit code %d)", r.FailedPhase, r.ExitCode)
+	case (r.FailedPhase == VMPhaseCreate || r.FailedPhase == VMPhaseBoot) && r.BootAttempts > 1:
+		return fmt.Sprintf("%s failed (%d attempts)", r.FailedPhase, r.BootAttempts)
+	default:
+		return fmt.Sprintf("%s failed", r.FailedPhase)
+	}
+}
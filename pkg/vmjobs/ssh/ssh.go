@@ -54,14 +54,18 @@ func (j *sshJob) ParseCfg(c *cli.Context) error {
 func (j *sshJob) Cmd() (string, bool) {
 	fmt.Printf("> ")
 	if j.scanner.Scan() {
-		suffix := "\n"
-		if !j.exitOnError {
-			suffix = " || true\n"
-		}
 		text := j.scanner.Text()
 		if !strings.HasPrefix(text, "exit") {
-			return text + suffix, true
+			return text + "\n", true
 		}
 	}
 	return "", false
 }
+
+// CmdExited reports failed commands, and goes on unless exit-on-error is set
+func (j *sshJob) CmdExited(VM string, exitCode int) bool {
+	if exitCode != 0 {
+		fmt.Printf("exit code %d\n", exitCode)
+	}
+	return exitCode == 0 || !j.exitOnError
+}
@@ -9,7 +9,8 @@ import (
 )
 
 var (
-	ImageParamDesc = "VM image to run the command on. Specify it multiple times for multiple vms."
+	ImageParamDesc = "VM image to run the command on. Specify it multiple times for multiple vms. " +
+		"Resources can be overridden per image, as in 'generic/fedora35:cpus=4,mem=4096'."
 )
 
 // VMJobConfigurator -> implements this interface to declare flags for your job and eventually parse them
@@ -29,6 +30,64 @@ type VMJobProcessor interface {
 	Done()
 }
 
+// VMJobLineProcessor -> implements this interface in place of VMJobProcessor to receive each output line along with
+// the stream it was printed to and when, eg: to tell compiler errors apart from results.
+// Backends unable to tell the two streams apart report all lines as stdout.
+type VMJobLineProcessor interface {
+	// ProcessLine -> processes each output line
+	ProcessLine(VM string, line OutputLine)
+	// Done -> called at the end of program, to let job flush its data if needed
+	Done()
+}
+
+// VMJobKernelDependent -> implements this interface to declare that your job depends on the VM kernel,
+// and must not run on backends sharing the host kernel (eg: containers)
+type VMJobKernelDependent interface {
+	// NeedsKernel -> whether the job needs its own kernel
+	NeedsKernel() bool
+}
+
+// VMJobProvisioner -> implements this interface to split the setup of the VM (eg: installing dependencies) from the job itself.
+// VMs can then be provisioned once per image and snapshotted, to be reused by following runs.
+type VMJobProvisioner interface {
+	// Provision -> commands setting the VM up, run before the ones of Cmd.
+	// Snapshots are reused as long as the commands do not change.
+	Provision() []string
+}
+
+// Upload -> a local file or directory to be copied into the VM
+type Upload struct {
+	// Src -> local path
+	Src string
+	// Dst -> path of the copy in the VM, which must not exist yet. Better relative, as all backends
+	// resolve relative paths from the default working directory of the commands (eg: the user home).
+	Dst string
+}
+
+// VMJobUploader -> implements this interface to copy local files or directories into the VM before the first command
+// of the job, eg: source trees or test fixtures. They are copied after provisioning, thus they are never part of snapshots.
+type VMJobUploader interface {
+	// Uploads -> files and directories to copy, in order
+	Uploads() []Upload
+}
+
+// VMJobCollector -> implements this interface to download files or directories out of the VM once the job is done,
+// eg: build products and logs. They are downloaded before halting the VM, even if the job or its provisioning failed.
+type VMJobCollector interface {
+	// Artifacts -> paths in the VM, or shell globs matching them. Relative ones are relative to the directory the commands run in.
+	// Paths matching nothing are skipped.
+	Artifacts() []string
+}
+
+// VMJobExitHandler -> implements this interface to receive the exit code of each command returned by Cmd, and to branch on it.
+// Without it, jobs stop at the first command exiting with a non-zero code.
+type VMJobExitHandler interface {
+	// CmdExited -> called once each command completes on VM, returns whether to go on sending the next commands,
+	// even after a failure. Jobs going on after a failure succeed or fail as their last command does.
+	// Not called for commands that could not run to completion (eg: timed out), which always end the job.
+	CmdExited(VM string, exitCode int) bool
+}
+
 // VMJob -> mandatory interface to be implemented
 type VMJob interface {
 	// Stringer -> name for the job
@@ -0,0 +1,143 @@
+package vmpool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"net"
+	"time"
+)
+
+// Maximum time for the daemon to answer a request
+const requestTimeout = 10 * time.Second
+
+// clientBackend -> a backend borrowing VMs from the daemon, and creating them itself when the daemon has none to lend
+type clientBackend struct {
+	vmbackends.VMBackend
+	socket       string
+	beforeCreate func(ctx context.Context, conf *vmbackends.VMConfig) error
+}
+
+// lentVM -> a VM borrowed from the daemon, already booted, and given back to it in place of being halted and destroyed
+type lentVM struct {
+	vmbackends.VM
+	conn net.Conn
+}
+
+// Running returns whether a daemon is listening on socket
+func Running(socket string) bool {
+	conn, err := net.DialTimeout("unix", socket, requestTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// NewBackend returns a backend borrowing VMs from the daemon listening on socket, whenever it has an idle one
+// matching the VMs to create, and creating them through backend otherwise.
+// Borrowed VMs are reattached to through backend, thus it must implement vmbackends.VMBackendLoader.
+// If not nil, beforeCreate is called before creating a VM through backend, eg: to wait for the host resources
+// it takes, which borrowed VMs do not, as the daemon booted them already.
+func NewBackend(backend vmbackends.VMBackend, socket string, beforeCreate func(ctx context.Context, conf *vmbackends.VMConfig) error) vmbackends.VMBackend {
+	return &clientBackend{VMBackend: backend, socket: socket, beforeCreate: beforeCreate}
+}
+
+func (b *clientBackend) Create(ctx context.Context, conf *vmbackends.VMConfig, info chan<- string) (vmbackends.VM, error) {
+	vm, err := b.borrow(ctx, conf)
+	if err != nil {
+		vmbackends.SendStr(info, "Creating a new VM, as the daemon did not lend one: "+err.Error())
+		if b.beforeCreate != nil {
+			err = b.beforeCreate(ctx, conf)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b.VMBackend.Create(ctx, conf, info)
+	}
+	vmbackends.SendStr(info, "Using a VM lent by the daemon")
+	return vm, nil
+}
+
+// borrow asks the daemon for an idle VM matching conf, and reattaches to it
+func (b *clientBackend) borrow(ctx context.Context, conf *vmbackends.VMConfig) (vmbackends.VM, error) {
+	loader, ok := b.VMBackend.(vmbackends.VMBackendLoader)
+	if !ok {
+		return nil, fmt.Errorf("'%s' backend can't reattach to VMs", b.VMBackend)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", b.socket)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(requestTimeout))
+	res := response{}
+	err = json.NewEncoder(conn).Encode(request{
+		Op:           opAcquire,
+		Backend:      b.VMBackend.String(),
+		BoxName:      conf.BoxName,
+		ProviderName: conf.ProviderName,
+		CPUs:         conf.CPUs,
+		Memory:       conf.Memory,
+	})
+	if err == nil {
+		err = json.NewDecoder(conn).Decode(&res)
+	}
+	if err == nil && len(res.Error) > 0 {
+		err = errors.New(res.Error)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// The VM lives in the folder of the daemon, the one of conf is left unused
+	c := *conf
+	c.Path = res.Path
+	vm, err := loader.Load(ctx, &c)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &lentVM{VM: vm, conn: conn}, nil
+}
+
+// Boot does nothing, lent VMs are already booted
+func (v *lentVM) Boot(ctx context.Context, info chan<- string) error {
+	return nil
+}
+
+// ExecStreams tells stdout and stderr apart, if the VM can
+func (v *lentVM) ExecStreams(ctx context.Context, cmd string, stdout, stderr chan<- string) error {
+	return vmbackends.ExecStreams(ctx, v.VM, cmd, stdout, stderr)
+}
+
+// Download downloads src, if the VM can
+func (v *lentVM) Download(ctx context.Context, src, dst string, info chan<- string) error {
+	d, ok := v.VM.(vmbackends.VMDownloader)
+	if !ok {
+		return errors.New("VM can't download files")
+	}
+	return d.Download(ctx, src, dst, info)
+}
+
+// Halt does nothing, lent VMs are reset by the daemon once given back
+func (v *lentVM) Halt(ctx context.Context, info chan<- string) error {
+	return nil
+}
+
+// Destroy gives the VM back to the daemon
+func (v *lentVM) Destroy(ctx context.Context, info chan<- string) error {
+	if v.conn == nil {
+		return nil
+	}
+	vmbackends.SendStr(info, "Giving the VM back to the daemon")
+	err := json.NewEncoder(v.conn).Encode(request{Op: opRelease})
+	v.conn.Close()
+	v.conn = nil
+	return err
+}
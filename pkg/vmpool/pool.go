@@ -0,0 +1,351 @@
+package vmpool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/workdir"
+	"golang.org/x/sync/semaphore"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Operations of the requests sent by clients to the daemon
+const (
+	opAcquire = "acquire"
+	opRelease = "release"
+)
+
+// Bounds of the wait before replacing a VM that failed, doubled at each consecutive failure,
+// so that the backend is not hammered when VMs keep failing to boot, whatever the retry policy
+const (
+	minFailureBackoff = 5 * time.Second
+	maxFailureBackoff = 10 * time.Minute
+)
+
+// request -> sent by clients as a JSON line, to acquire an idle VM matching it and then to release it
+type request struct {
+	Op           string `json:"op"`
+	Backend      string `json:"backend,omitempty"`
+	BoxName      string `json:"boxName,omitempty"`
+	ProviderName string `json:"providerName,omitempty"`
+	CPUs         int    `json:"cpus,omitempty"`
+	Memory       int    `json:"memory,omitempty"`
+}
+
+// response -> sent by the daemon as a JSON line, with the path of the lent VM or why none was
+type response struct {
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Hooks -> functions called by the pool as its VMs change, from any goroutine. Any of them can be nil.
+type Hooks struct {
+	// Created -> a new VM is about to be created
+	Created func(conf *vmbackends.VMConfig)
+	// Ready -> the VM is booted, or got reset, and waits to be lent
+	Ready func(conf *vmbackends.VMConfig)
+	// Lent -> the VM got lent to a client
+	Lent func(conf *vmbackends.VMConfig)
+	// Destroyed -> the VM got destroyed, err is why, or why destroying it failed, if anything went wrong
+	Destroyed func(conf *vmbackends.VMConfig, err error)
+	// Info -> progress line reported by the backend for the VM
+	Info func(conf *vmbackends.VMConfig, line string)
+}
+
+// Pool -> VMs booted ahead of time, lent to clients one job at a time.
+// Once given back, VMs are reset to their state right after boot if they implement
+// vmbackends.VMResetter, or replaced by new ones otherwise.
+type Pool struct {
+	Hooks
+	backend vmbackends.VMBackend
+	run     *workdir.Run
+	// sm -> limits the VMs being booted or reset at the same time
+	sm *semaphore.Weighted
+
+	mu    sync.Mutex
+	idle  []*pooledVM
+	count int
+	wg    sync.WaitGroup
+}
+
+// pooledVM -> a booted VM of the pool
+type pooledVM struct {
+	conf *vmbackends.VMConfig
+	vm   vmbackends.VM
+	// released -> closed once the VM is given back, after being lent
+	released chan struct{}
+}
+
+// New returns an empty pool creating VMs of backend in the folder of run, booting up to parallelism of them at once
+func New(backend vmbackends.VMBackend, run *workdir.Run, parallelism int) *Pool {
+	return &Pool{
+		backend: backend,
+		run:     run,
+		sm:      semaphore.NewWeighted(int64(parallelism)),
+	}
+}
+
+// Start keeps size VMs described by conf in the pool, until ctx is done.
+// Path is ignored, each VM gets its own folder in the run one.
+func (p *Pool) Start(ctx context.Context, conf *vmbackends.VMConfig, size int) {
+	for i := 0; i < size; i++ {
+		p.wg.Add(1)
+		go p.keep(ctx, conf)
+	}
+}
+
+// Wait waits for all VMs to be destroyed, once the ctx passed to Start is done.
+// Lent VMs are destroyed once given back.
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
+
+// Serve lends the VMs of the pool to the clients connecting to l, until l is closed
+func (p *Pool) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go p.handle(conn)
+	}
+}
+
+// handle lends an idle VM to the client of conn, if any matches its request, until the client gives it
+// back or disconnects. VMs are lent to a single client at a time, thus clients never wait for them.
+func (p *Pool) handle(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	var req request
+	if dec.Decode(&req) != nil || req.Op != opAcquire {
+		return
+	}
+	v := p.take(&req)
+	if v == nil {
+		_ = enc.Encode(response{Error: fmt.Sprintf("no idle '%s' VM with %d cpus and %d memory", req.BoxName, req.CPUs, req.Memory)})
+		return
+	}
+	defer close(v.released)
+	if p.Lent != nil {
+		p.Lent(v.conf)
+	}
+	if enc.Encode(response{Path: v.conf.Path}) != nil {
+		return
+	}
+	// Clients that die without releasing the VM give it back all the same
+	_ = dec.Decode(&req)
+}
+
+// keep keeps a VM described by conf in the pool, replacing it whenever it gets destroyed, until ctx is done
+func (p *Pool) keep(ctx context.Context, conf *vmbackends.VMConfig) {
+	defer p.wg.Done()
+	// failures -> number of consecutive VMs that failed before being lent
+	failures := 0
+	for ctx.Err() == nil {
+		c := *conf
+		p.mu.Lock()
+		c.Path = p.run.VMPath(p.count, c.BoxName)
+		p.count++
+		p.mu.Unlock()
+
+		var vm vmbackends.VM
+		err := p.phase(ctx, &c, c.BootTimeout, func(ctx context.Context, info chan<- string) error {
+			var err error
+			vm, err = p.boot(ctx, &c, info)
+			return err
+		})
+		if err == nil {
+			failures = 0
+			err = p.lend(ctx, &c, vm)
+		}
+		if ctx.Err() != nil {
+			// Failures caused by the pool stopping are expected
+			err = nil
+		}
+		p.destroy(&c, vm, err)
+		if err != nil && ctx.Err() == nil {
+			failures++
+			select {
+			case <-ctx.Done():
+			case <-time.After(failureBackoff(conf.BootRetry, failures)):
+			}
+		}
+	}
+}
+
+// failureBackoff returns the wait before replacing a VM after the given number of consecutive failures.
+// It starts from the backoff of policy, or minFailureBackoff if lower, and it is doubled up to maxFailureBackoff.
+func failureBackoff(policy vmbackends.RetryPolicy, failures int) time.Duration {
+	d := policy.Backoff
+	if d < minFailureBackoff {
+		d = minFailureBackoff
+	}
+	for i := 1; i < failures && d < maxFailureBackoff; i++ {
+		d *= 2
+	}
+	if d > maxFailureBackoff {
+		d = maxFailureBackoff
+	}
+	return d
+}
+
+// boot creates and boots a new VM, then saves its state to reset it to after each job.
+// The VM is returned even on failure, if it got created.
+func (p *Pool) boot(ctx context.Context, conf *vmbackends.VMConfig, info chan<- string) (vmbackends.VM, error) {
+	if p.Created != nil {
+		p.Created(conf)
+	}
+	vm, err := p.backend.Create(ctx, conf, info)
+	if err != nil {
+		return nil, err
+	}
+	err = vm.Boot(ctx, info)
+	if err != nil {
+		return vm, err
+	}
+	if resetter, ok := vm.(vmbackends.VMResetter); ok {
+		vmbackends.SendStr(info, "Saving the state to reset the VM to after each job")
+		err = resetter.Checkpoint(ctx, info)
+	}
+	return vm, err
+}
+
+// lend puts vm in the pool, and waits for it to be lent and given back, resetting it each time.
+// It returns once vm has to be destroyed.
+func (p *Pool) lend(ctx context.Context, conf *vmbackends.VMConfig, vm vmbackends.VM) error {
+	for {
+		v := &pooledVM{conf: conf, vm: vm, released: make(chan struct{})}
+		p.mu.Lock()
+		p.idle = append(p.idle, v)
+		p.mu.Unlock()
+		if p.Ready != nil {
+			p.Ready(conf)
+		}
+		select {
+		case <-v.released:
+		case <-ctx.Done():
+			if p.remove(v) {
+				return nil
+			}
+			<-v.released
+			return nil
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		resetter, ok := vm.(vmbackends.VMResetter)
+		if !ok {
+			return nil
+		}
+		err := p.phase(ctx, conf, conf.BootTimeout, func(ctx context.Context, info chan<- string) error {
+			err := resetter.Reset(ctx, info)
+			if err != nil {
+				return fmt.Errorf("reset failed: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// destroy destroys vm, if it got created, even if the pool is stopping, along with its folder
+func (p *Pool) destroy(conf *vmbackends.VMConfig, vm vmbackends.VM, cause error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if conf.TeardownTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, conf.TeardownTimeout)
+	}
+	defer cancel()
+
+	info, wait := p.infoChan(conf)
+	var err error
+	if vm != nil {
+		err = vm.Destroy(ctx, info)
+	}
+	close(info)
+	wait()
+	if rmErr := os.RemoveAll(conf.Path); err == nil {
+		err = rmErr
+	}
+	if cause != nil {
+		err = cause
+	}
+	if p.Destroyed != nil {
+		p.Destroyed(conf, err)
+	}
+}
+
+// phase runs f with a timeout, after waiting for its turn
+func (p *Pool) phase(ctx context.Context, conf *vmbackends.VMConfig, timeout time.Duration, f func(ctx context.Context, info chan<- string) error) error {
+	err := p.sm.Acquire(ctx, 1)
+	if err != nil {
+		return err
+	}
+	defer p.sm.Release(1)
+	phaseCtx, cancel := context.WithCancel(ctx)
+	if timeout > 0 {
+		phaseCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	info, wait := p.infoChan(conf)
+	err = f(phaseCtx, info)
+	close(info)
+	wait()
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("timed out after %v: %w", timeout, err)
+	}
+	return err
+}
+
+// infoChan returns a channel relaying the lines sent to it to the Info hook.
+// The channel must be closed, then the returned function called, to wait for all lines to be relayed.
+func (p *Pool) infoChan(conf *vmbackends.VMConfig) (chan string, func()) {
+	info := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		for l := range info {
+			if p.Info != nil {
+				p.Info(conf, l)
+			}
+		}
+		close(done)
+	}()
+	return info, func() { <-done }
+}
+
+// take removes the first idle VM matching req from the pool, and returns it
+func (p *Pool) take(req *request) *pooledVM {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, v := range p.idle {
+		if req.Backend == p.backend.String() && req.BoxName == v.conf.BoxName &&
+			req.ProviderName == v.conf.ProviderName && req.CPUs == v.conf.CPUs && req.Memory == v.conf.Memory {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			return v
+		}
+	}
+	return nil
+}
+
+// remove removes v from the pool, and returns whether it was still idle
+func (p *Pool) remove(v *pooledVM) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, idle := range p.idle {
+		if idle == v {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package vmpool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jasondellaluce/experiments/vm-spinner/pkg/vmbackends"
+)
+
+func TestFailureBackoff(t *testing.T) {
+	tests := []struct {
+		backoff  time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{0, 1, minFailureBackoff},
+		{0, 2, 2 * minFailureBackoff},
+		{0, 1000, maxFailureBackoff},
+		{30 * time.Second, 1, 30 * time.Second},
+		{30 * time.Second, 3, 2 * time.Minute},
+		{30 * time.Second, 10, maxFailureBackoff},
+		{time.Hour, 1, maxFailureBackoff},
+	}
+	for _, tt := range tests {
+		got := failureBackoff(vmbackends.RetryPolicy{Backoff: tt.backoff}, tt.failures)
+		if got != tt.want {
+			t.Errorf("failureBackoff(%v, %d) = %v, expected %v", tt.backoff, tt.failures, got, tt.want)
+		}
+	}
+}
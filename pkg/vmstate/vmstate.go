@@ -0,0 +1,129 @@
+package vmstate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Record -> a VM created by vm-spinner, with all that is needed to reattach to it later
+type Record struct {
+	Backend      string `json:"backend"`
+	Path         string `json:"path"`
+	BoxName      string `json:"boxName"`
+	ProviderName string `json:"providerName"`
+	CPUs         int    `json:"cpus"`
+	Memory       int    `json:"memory"`
+	Job          string `json:"job"`
+	// Pid, Start -> process owning the VM, and when it started creating it
+	Pid   int       `json:"pid"`
+	Start time.Time `json:"start"`
+	// KeptAt -> when the VM was kept alive after its job, zero if it was not
+	KeptAt   time.Time `json:"keptAt,omitempty"`
+	ShellCmd string    `json:"shellCmd,omitempty"`
+}
+
+// Kept returns whether the VM was kept alive after its job, thus it has no owner anymore
+func (r *Record) Kept() bool {
+	return !r.KeptAt.IsZero()
+}
+
+// OwnerAlive returns whether the process owning the VM is still running.
+// Pids might be reused, thus this is a best effort check.
+func (r *Record) OwnerAlive() bool {
+	if r.Pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(r.Pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Store -> a folder containing a JSON file for each record
+type Store struct {
+	dir string
+}
+
+// DefaultDir returns the default folder of the store, following the XDG base directory spec
+func DefaultDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); len(dir) > 0 {
+		return filepath.Join(dir, "vm-spinner")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "vm-spinner")
+	}
+	return filepath.Join(os.TempDir(), "vm-spinner-state")
+}
+
+// Open returns the store in dir, creating dir if needed
+func Open(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir returns the folder of the store
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+func (s *Store) file(r *Record) string {
+	name := strings.Trim(strings.ReplaceAll(filepath.Clean(r.Path), string(filepath.Separator), "_"), "_")
+	return filepath.Join(s.dir, name+".json")
+}
+
+// Save adds r to the store, replacing any record of a VM with the same path
+func (s *Store) Save(r *Record) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write and rename, so that concurrent readers never see partial records
+	tmp := s.file(r) + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file(r))
+}
+
+// Remove deletes r from the store, if present
+func (s *Store) Remove(r *Record) error {
+	err := os.Remove(s.file(r))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns all the records of the store, oldest first
+func (s *Store) List() ([]*Record, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*Record, 0, len(files))
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		r := &Record{}
+		err = json.Unmarshal(data, r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", f, err)
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Start.Before(records[j].Start)
+	})
+	return records, nil
+}
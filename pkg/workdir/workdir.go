@@ -0,0 +1,159 @@
+package workdir
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// File held locked by the owner of a run folder, for as long as the run lasts
+const lockFile = ".lock"
+
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// Run -> the folder of a single run, containing a folder for each of its VMs
+type Run struct {
+	ID   string
+	Dir  string
+	lock *os.File
+}
+
+// DefaultRoot returns the default folder containing the folders of all runs
+func DefaultRoot() string {
+	return filepath.Join(os.TempDir(), "vm-spinner")
+}
+
+// NewRun creates a new run folder with a unique ID in root, and locks it until Close is called
+func NewRun(root string) (*Run, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		id, err := newID()
+		if err != nil {
+			return nil, err
+		}
+		dir := filepath.Join(root, id)
+		err = os.Mkdir(dir, 0755)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		lock, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+		if err == nil {
+			err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		}
+		if err != nil {
+			if lock != nil {
+				lock.Close()
+			}
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		_, _ = lock.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+		return &Run{ID: id, Dir: dir, lock: lock}, nil
+	}
+}
+
+// newID returns a run ID sorting by creation time, and unlikely to collide with concurrent runs
+func newID() (string, error) {
+	b := make([]byte, 3)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b), nil
+}
+
+// VMPath returns the folder of the i-th VM of the run, running the given image
+func (r *Run) VMPath(i int, image string) string {
+	return filepath.Join(r.Dir, fmt.Sprintf("%d-%s", i, SanitizeName(image)))
+}
+
+// Close releases the run folder, and deletes it if no VM folder was left in it (eg: VMs kept alive)
+func (r *Run) Close() error {
+	err := r.lock.Close()
+	if rmErr := removeIfUnused(r.Dir); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// SanitizeName turns name (eg: a Vagrant box name) into a single path element
+func SanitizeName(name string) string {
+	return invalidNameChars.ReplaceAllString(name, "_")
+}
+
+// Locked returns whether the run folder dir is still locked by its owner
+func Locked(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, lockFile))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return errors.Is(syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB), syscall.EWOULDBLOCK)
+}
+
+// Prune deletes the run folders in root that are neither locked nor contain any VM folder
+func Prune(root string) error {
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		dir := filepath.Join(root, e.Name())
+		if !e.IsDir() || Locked(dir) {
+			continue
+		}
+		// Runs lock their folder right after creating it, skip the ones that might be in between
+		info, err := os.Stat(filepath.Join(dir, lockFile))
+		if err != nil {
+			info, err = e.Info()
+		}
+		if err != nil || time.Since(info.ModTime()) < time.Minute {
+			continue
+		}
+		err = removeIfUnused(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveIfDone deletes the run folder dir if the run is over and no VM folder is left in it, eg: once its
+// kept VMs are destroyed. Folders that are not the one of a run are left alone.
+func RemoveIfDone(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, lockFile)); err != nil || Locked(dir) {
+		return nil
+	}
+	return removeIfUnused(dir)
+}
+
+// removeIfUnused deletes dir if it contains nothing but its lock file
+func removeIfUnused(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() != lockFile {
+			return nil
+		}
+	}
+	return os.RemoveAll(dir)
+}